@@ -0,0 +1,650 @@
+package client
+
+import (
+	"number_guessing/game"
+	"number_guessing/protocol"
+
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// region connection remote
+
+type RemoteCommand interface{}
+
+type RemoteCommandGuess struct {
+	Number int64
+}
+
+type RemoteCommandShow struct{}
+
+type RemoteCommandStop struct{}
+
+type RemoteCommandScore struct{}
+
+type RemoteCommandStatus struct{}
+
+type RemoteCommandList struct{}
+
+type RemoteCommandStats struct{}
+
+type RemoteCommandSay struct {
+	Message string
+}
+
+type RemoteCommandPing struct{}
+
+type RemoteCommandRestart struct{}
+
+type ConnectionRemote struct {
+	cmdChan chan RemoteCommand
+	events  chan game.GameEvent
+	logger  *slog.Logger
+	timeout time.Duration
+	// host and joinAs are kept for reconnect attempts; joinAs holds the
+	// name the server actually assigned so a resumed session keeps it.
+	host     string
+	redial   func() (net.Conn, error)
+	joinAs   string
+	room     string
+	role     protocol.PlayerRole
+	token    [16]byte
+	password string
+	retries  int
+	// lastRTT is the most recent keepalive round-trip time to the server.
+	lastRTT time.Duration
+	// lo/hi track the valid range from received guess results, written by
+	// the session loop and read by Hint from the REPL goroutine, so they
+	// are guarded by boundsMu. maxNumber comes from the join response and
+	// never changes after construction.
+	boundsMu  sync.Mutex
+	lo, hi    int64
+	maxNumber int64
+	// done is closed when the session loop exits; command sends select
+	// against it so they cannot block on a dead connection. sessionCtx
+	// mirrors it for Context().
+	done          chan struct{}
+	sessionCtx    context.Context
+	sessionCancel context.CancelFunc
+	stopped       atomic.Bool
+}
+
+// NewConnectionRemote joins a hosted game over TCP.
+func NewConnectionRemote(host string, joinAs string, timeout time.Duration, retries int, role protocol.PlayerRole, password string) (game.Connection, error) {
+	return NewConnectionRemoteRoom(host, joinAs, timeout, retries, role, password, "")
+}
+
+// NewConnectionRemoteRoom joins a specific room on a multi-room server.
+func NewConnectionRemoteRoom(host, joinAs string, timeout time.Duration, retries int, role protocol.PlayerRole, password, roomName string) (game.Connection, error) {
+	server, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	return newConnectionRemote(server, joinAs, timeout, retries, role, password, roomName)
+}
+
+// NewConnectionSpectator joins a hosted game as an observer: it receives
+// every broadcast but cannot guess or reveal. Password and room gate the
+// join exactly as for players.
+func NewConnectionSpectator(host, name, password, roomName string) (game.Connection, error) {
+	server, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	return newConnectionRemote(server, name, 0, 0, protocol.RoleSpectator, password, roomName)
+}
+
+// DialWithRetry joins a hosted game, retrying the initial dial with
+// exponential backoff (doubling from baseDelay, capped at 30s, ±10%
+// jitter) up to maxAttempts times. On success the connection keeps the
+// same attempt budget for mid-game reconnects.
+func DialWithRetry(host, joinAs string, maxAttempts int, baseDelay time.Duration) (game.Connection, error) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if baseDelay <= 0 {
+		baseDelay = time.Second
+	}
+	delay := baseDelay
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		conn, err := NewConnectionRemote(host, joinAs, 0, maxAttempts, protocol.RolePlayer, "")
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if attempt == maxAttempts {
+			break
+		}
+		wait := jitterDelay(delay)
+		game.PrintOutf("retrying in %s… (attempt %d/%d)", wait.Round(time.Millisecond), attempt, maxAttempts)
+		time.Sleep(wait)
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+	return nil, lastErr
+}
+
+// jitterDelay spreads a backoff delay by ±10% so simultaneous clients
+// don't retry in lockstep.
+func jitterDelay(delay time.Duration) time.Duration {
+	factor := 0.9 + 0.2*rand.Float64()
+	return time.Duration(float64(delay) * factor)
+}
+
+// NewConnectionRemoteUnix joins a game served on a Unix domain socket.
+func NewConnectionRemoteUnix(path, joinAs string) (game.Connection, error) {
+	dial := func() (net.Conn, error) {
+		return net.Dial("unix", path)
+	}
+	server, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return newConnectionRemoteDial(server, joinAs, 0, 0, protocol.RolePlayer, "", "", dial)
+}
+
+// NewConnectionRemoteTLS joins a game over TLS. serverName overrides the
+// name used for certificate verification; insecureSkipVerify disables
+// verification entirely (self-signed servers).
+func NewConnectionRemoteTLS(host, joinAs, serverName string, insecureSkipVerify bool) (game.Connection, error) {
+	return NewConnectionRemoteTLSCA(host, joinAs, serverName, "", insecureSkipVerify, TLSJoinOptions{})
+}
+
+// TLSJoinOptions carries the session settings a TLS join shares with the
+// plain connect path.
+type TLSJoinOptions struct {
+	Timeout  time.Duration
+	Retries  int
+	Password string
+	Room     string
+}
+
+// NewConnectionRemoteTLSCA additionally trusts the certificates in caFile,
+// letting a self-signed server verify without disabling checks.
+func NewConnectionRemoteTLSCA(host, joinAs, serverName, caFile string, insecureSkipVerify bool, opts TLSJoinOptions) (game.Connection, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	dial := func() (net.Conn, error) {
+		return tls.Dial("tcp", host, config)
+	}
+	server, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake failed: %w", err)
+	}
+	return newConnectionRemoteDial(server, joinAs, opts.Timeout, opts.Retries, protocol.RolePlayer, opts.Password, opts.Room, dial)
+}
+
+// handshakeAndJoin performs the magic/version exchange and the join on an
+// established connection, returning the assigned name and negotiated
+// version.
+func handshakeAndJoin(server net.Conn, joinAs string, role protocol.PlayerRole, token [16]byte, password, roomName string) (*bufio.Reader, string, int64, error) {
+	reader := bufio.NewReader(server)
+	protocol.UpdateDeadline(server, protocol.DefaultTimeout)
+	if err := protocol.SendMagicAndProtoVer(server); err != nil {
+		server.Close()
+		return nil, "", 0, err
+	}
+	if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+		server.Close()
+		return nil, "", 0, err
+	}
+
+	protocol.UpdateDeadline(server, protocol.DefaultTimeout)
+	challengePacket, err := protocol.ReadPacket(reader)
+	if err != nil {
+		server.Close()
+		return nil, "", 0, err
+	}
+	challenge, ok := challengePacket.(protocol.PacketAuthChallenge)
+	if !ok {
+		server.Close()
+		return nil, "", 0, errors.New("expected auth challenge")
+	}
+	if challenge.Required {
+		protocol.UpdateSendDeadline(server, protocol.DefaultTimeout)
+		if err := protocol.SendPacket(server, protocol.PacketPassword{Password: password}); err != nil {
+			server.Close()
+			return nil, "", 0, err
+		}
+	}
+
+	protocol.UpdateSendDeadline(server, protocol.DefaultTimeout)
+	if err := protocol.SendPacket(server, protocol.PacketJoinAs{Name: joinAs, Role: role, Token: token, Room: roomName}); err != nil {
+		server.Close()
+		return nil, "", 0, err
+	}
+
+	protocol.UpdateDeadline(server, protocol.DefaultTimeout)
+	packet, err := protocol.ReadPacket(reader)
+	if err != nil {
+		server.Close()
+		return nil, "", 0, err
+	}
+	var assigned string
+	var joinedMax int64
+	switch p := packet.(type) {
+	case protocol.PacketJoinAs:
+		if role == protocol.RoleSpectator {
+			game.PrintOutf("watching as %s, range [0, %d)", p.Name, p.Max)
+		} else {
+			game.PrintOutf("joined as %s, range [0, %d)", p.Name, p.Max)
+		}
+		assigned = p.Name
+		joinedMax = p.Max
+	case protocol.PacketDisconnect:
+		server.Close()
+		return nil, "", 0, p.Reason
+	default:
+		server.Close()
+		return nil, "", 0, errors.New("unexpected join response")
+	}
+	_ = server.SetDeadline(time.Time{})
+	return reader, assigned, joinedMax, nil
+}
+
+// newConnectionRemote performs the handshake and join exchange on an
+// established connection and starts the client loop. A zero timeout
+// selects protocol.DefaultTimeout; a negative one disables play-phase deadlines.
+func newConnectionRemote(server net.Conn, joinAs string, timeout time.Duration, retries int, role protocol.PlayerRole, password, roomName string) (game.Connection, error) {
+	return newConnectionRemoteDial(server, joinAs, timeout, retries, role, password, roomName, nil)
+}
+
+// newConnectionRemoteDial additionally takes the dial function used for
+// mid-game reconnects, so a TLS or Unix-socket session re-dials over its
+// own transport; nil falls back to plain TCP against the original host.
+func newConnectionRemoteDial(server net.Conn, joinAs string, timeout time.Duration, retries int, role protocol.PlayerRole, password, roomName string, redial func() (net.Conn, error)) (game.Connection, error) {
+	reader, assigned, joinedMax, err := handshakeAndJoin(server, joinAs, role, [16]byte{}, password, roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout == 0 {
+		timeout = protocol.DefaultTimeout
+	}
+	sessionCtx, sessionCancel := context.WithCancel(context.Background())
+	conn := &ConnectionRemote{
+		// Buffered so commands typed during a reconnect queue up and are
+		// replayed once the session resumes instead of stalling the REPL.
+		cmdChan:       make(chan RemoteCommand, 16),
+		sessionCtx:    sessionCtx,
+		sessionCancel: sessionCancel,
+		events:        make(chan game.GameEvent, game.EventBufferSize),
+		logger:        protocol.DefaultLogger,
+		done:          make(chan struct{}),
+		timeout:       timeout,
+		retries:       retries,
+		joinAs:        assigned,
+		role:          role,
+		room:          roomName,
+		password:      password,
+		maxNumber:     joinedMax,
+		hi:            joinedMax,
+	}
+	if addr := server.RemoteAddr(); addr != nil {
+		conn.host = addr.String()
+	}
+	conn.redial = redial
+	if conn.redial == nil {
+		host := conn.host
+		conn.redial = func() (net.Conn, error) {
+			return net.Dial("tcp", host)
+		}
+	}
+	go conn.run(server, reader)
+	return conn, nil
+}
+
+// run owns the connection for its lifetime, re-dialing with exponential
+// backoff when the session drops unexpectedly and reconnects are enabled.
+func (c *ConnectionRemote) run(server net.Conn, reader *bufio.Reader) {
+	defer c.sessionCancel()
+	defer close(c.done)
+	defer c.stopped.Store(true)
+	for {
+		done := c.clientLoop(server, reader)
+		server.Close()
+		if done || c.retries <= 0 {
+			return
+		}
+		var ok bool
+		server, reader, ok = c.reconnect()
+		if !ok {
+			return
+		}
+	}
+}
+
+// reconnect re-dials the server with exponential backoff, rejoining under
+// the previously assigned name.
+func (c *ConnectionRemote) reconnect() (net.Conn, *bufio.Reader, bool) {
+	delay := time.Second
+	for attempt := 1; attempt <= c.retries; attempt++ {
+		c.events <- game.GameEventMessage{Text: fmt.Sprintf("reconnecting in %s... (attempt %d/%d)", delay, attempt, c.retries)}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+		server, err := c.redial()
+		if err != nil {
+			continue
+		}
+		reader, assigned, _, err := handshakeAndJoin(server, c.joinAs, c.role, c.token, c.password, c.room)
+		if err != nil {
+			if errors.Is(err, protocol.TokenExpired) {
+				// The server no longer knows our session (restarted or the
+				// grace period passed); fall back to a fresh join.
+				c.token = [16]byte{}
+			}
+			continue
+		}
+		c.joinAs = assigned
+		c.events <- game.GameEventMessage{Text: "reconnected"}
+		return server, reader, true
+	}
+	c.events <- game.GameEventMessage{Text: "failed to reconnect, giving up"}
+	return nil, nil, false
+}
+
+// clientLoop serves one session. It reports whether the connection ended
+// deliberately (user stop or server disconnect); any other failure lets
+// run() attempt a reconnect.
+func (c *ConnectionRemote) clientLoop(server net.Conn, reader *bufio.Reader) bool {
+	recvChan := make(chan protocol.Packet)
+	recvErrChan := make(chan error)
+	// readerDone unblocks the receive goroutine when this loop returns for
+	// a non-read reason; the deferred connection close unblocks its read.
+	readerDone := make(chan struct{})
+	defer close(readerDone)
+	go func() {
+		var lastSeq uint32
+		for {
+			seqPacket, err := protocol.ReadSeqPacket(reader)
+			if err != nil {
+				select {
+				case recvErrChan <- err:
+				case <-readerDone:
+				}
+				return
+			}
+			if protocol.SequencedProtocol {
+				if seqPacket.Seq <= lastSeq {
+					c.logger.Warn("packet arrived out of order", "seq", seqPacket.Seq, "last", lastSeq)
+				}
+				lastSeq = seqPacket.Seq
+			}
+			select {
+			case recvChan <- seqPacket.Packet:
+			case <-readerDone:
+				return
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(protocol.DefaultPingInterval)
+	defer pingTicker.Stop()
+	var pongTimer *time.Timer
+	var pongDeadline <-chan time.Time
+	var pingNonce uint64
+	var pingSent time.Time
+	manualPing := false
+	defer func() {
+		if pongTimer != nil {
+			pongTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-pingTicker.C:
+			pingNonce = rand.Uint64()
+			pingSent = time.Now()
+			protocol.UpdateSendDeadline(server, c.timeout)
+			if err := protocol.SendPacket(server, protocol.PacketPing{Nonce: pingNonce}); err != nil {
+				protocol.FailedToSend(c.logger, "server", err)
+				return false
+			}
+			pongTimer = time.NewTimer(protocol.PongWait)
+			pongDeadline = pongTimer.C
+		case <-pongDeadline:
+			protocol.UnexpectedClose(c.logger, "server", errors.New("no answer to keepalive ping"))
+			return false
+		case cmd := <-c.cmdChan:
+			protocol.UpdateSendDeadline(server, c.timeout)
+			var err error
+			switch cmd := cmd.(type) {
+			case RemoteCommandGuess:
+				err = protocol.SendPacket(server, protocol.PacketGuess{Number: cmd.Number})
+			case RemoteCommandShow:
+				err = protocol.SendPacket(server, protocol.PacketShow{})
+			case RemoteCommandScore:
+				err = protocol.SendPacket(server, protocol.PacketScoreRequest{})
+			case RemoteCommandStatus:
+				err = protocol.SendPacket(server, protocol.PacketStatus{})
+			case RemoteCommandList:
+				err = protocol.SendPacket(server, protocol.PacketPlayerListRequest{})
+			case RemoteCommandStats:
+				err = protocol.SendPacket(server, protocol.PacketStatsRequest{})
+			case RemoteCommandSay:
+				err = protocol.SendPacket(server, protocol.PacketChat{Message: cmd.Message})
+			case RemoteCommandRestart:
+				err = protocol.SendPacket(server, protocol.PacketRestart{})
+			case RemoteCommandPing:
+				pingNonce = rand.Uint64()
+				pingSent = time.Now()
+				manualPing = true
+				err = protocol.SendPacket(server, protocol.PacketPing{Nonce: pingNonce})
+				if err == nil {
+					pongTimer = time.NewTimer(protocol.PongWait)
+					pongDeadline = pongTimer.C
+				}
+			case RemoteCommandStop:
+				_ = protocol.SendPacket(server, protocol.PacketDisconnect{Reason: protocol.Normal})
+				return true
+			}
+			if err != nil {
+				protocol.FailedToSend(c.logger, "server", err)
+				return false
+			}
+		case err := <-recvErrChan:
+			protocol.UnexpectedClose(c.logger, "server", err)
+			return false
+		case packet := <-recvChan:
+			switch p := packet.(type) {
+			case protocol.PacketMsg:
+				c.events <- game.GameEventMessage{Text: p.Msg}
+			case protocol.PacketScoreboard:
+				c.events <- game.GameEventScoreboard{Scores: p.Scores}
+			case protocol.PacketGuessResult:
+				c.boundsMu.Lock()
+				c.lo, c.hi = p.Lo, p.Hi
+				c.boundsMu.Unlock()
+				c.events <- game.GameEventGameGuess{Name: "you", Number: p.Number, Result: p.Result}
+				if p.Result != game.Equal && p.Hi > p.Lo {
+					c.events <- game.GameEventMessage{Text: fmt.Sprintf("valid range [%d, %d)", p.Lo, p.Hi)}
+				}
+			case protocol.PacketEvent:
+				if _, ok := p.Event.(game.GameEventGameNew); ok {
+					c.boundsMu.Lock()
+					c.lo, c.hi = 0, c.maxNumber
+					c.boundsMu.Unlock()
+				}
+				c.events <- p.Event
+			case protocol.PacketToken:
+				c.token = p.Token
+			case protocol.PacketHistory:
+				for _, line := range p.Events {
+					game.PrintOutf("[history] %s", line)
+				}
+			case protocol.PacketIdleWarning:
+				c.events <- game.GameEventMessage{Text: "you are idle and will be disconnected soon"}
+			case protocol.PacketPing:
+				protocol.UpdateSendDeadline(server, c.timeout)
+				if err := protocol.SendPacket(server, protocol.PacketPong{Nonce: p.Nonce}); err != nil {
+					protocol.FailedToSend(c.logger, "server", err)
+					return false
+				}
+			case protocol.PacketPong:
+				if p.Nonce == pingNonce && pongTimer != nil {
+					pongTimer.Stop()
+					pongDeadline = nil
+					c.lastRTT = time.Since(pingSent)
+					if manualPing {
+						manualPing = false
+						c.events <- game.GameEventMessage{Text: fmt.Sprintf("rtt: %s", c.lastRTT)}
+					}
+				}
+			case protocol.PacketPlayerList:
+				text := fmt.Sprintf("players (%d/%d): %s", len(p.Names), p.Target, strings.Join(p.Names, ", "))
+				if len(p.Spectators) > 0 {
+					text += fmt.Sprintf(" — watching: %s", strings.Join(p.Spectators, ", "))
+				}
+				c.events <- game.GameEventMessage{Text: text}
+			case protocol.PacketStats:
+				c.events <- game.GameEventMessage{Text: "session stats\n" + game.FormatStats(p.Stats)}
+			case protocol.PacketStatusResp:
+				state := "waiting for players"
+				if p.Playable {
+					state = "running"
+				}
+				c.events <- game.GameEventMessage{Text: fmt.Sprintf("players: %d/%d, game %s", p.CurrentPlayers, p.TargetPlayers, state)}
+			case protocol.PacketDisconnect:
+				c.events <- game.GameEventGameStop{Reason: p.Reason.Error()}
+				return true
+			default:
+				fmt.Fprintf(os.Stderr, "unexpected packet from server: %T\n", packet)
+			}
+		}
+	}
+}
+
+// errConnectionClosed reports a command issued after the session loop
+// exited.
+var errConnectionClosed = errors.New("connection closed")
+
+// send queues a command for the session loop, failing instead of
+// blocking forever when the connection is already gone.
+func (c *ConnectionRemote) send(cmd RemoteCommand) error {
+	return c.sendCtx(context.Background(), cmd)
+}
+
+// sendCtx is send with a caller-supplied deadline.
+func (c *ConnectionRemote) sendCtx(ctx context.Context, cmd RemoteCommand) error {
+	select {
+	case c.cmdChan <- cmd:
+		return nil
+	case <-c.done:
+		return errConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendOrPrint is for the fire-and-forget command methods that have no
+// error return of their own.
+func (c *ConnectionRemote) sendOrPrint(cmd RemoteCommand) {
+	if err := c.send(cmd); err != nil {
+		game.PrintOut(err.Error())
+	}
+}
+
+// Guess queues the guess; the result arrives asynchronously through
+// Events, so the returned game.GuessResult is always the zero value.
+func (c *ConnectionRemote) Guess(ctx context.Context, number int64) (game.GuessResult, error) {
+	return 0, c.sendCtx(ctx, RemoteCommandGuess{Number: number})
+}
+
+// Show queues the reveal request; the number arrives through Events.
+func (c *ConnectionRemote) Show(ctx context.Context) (int64, error) {
+	return 0, c.sendCtx(ctx, RemoteCommandShow{})
+}
+
+func (c *ConnectionRemote) Restart() error {
+	return c.send(RemoteCommandRestart{})
+}
+
+func (c *ConnectionRemote) Stop() error {
+	return c.send(RemoteCommandStop{})
+}
+
+func (c *ConnectionRemote) RemoteStopped() bool {
+	return c.stopped.Load()
+}
+
+func (c *ConnectionRemote) Scores() {
+	c.sendOrPrint(RemoteCommandScore{})
+}
+
+func (c *ConnectionRemote) Status() {
+	c.sendOrPrint(RemoteCommandStatus{})
+}
+
+func (c *ConnectionRemote) List() {
+	c.sendOrPrint(RemoteCommandList{})
+}
+
+func (c *ConnectionRemote) Say(message string) {
+	c.sendOrPrint(RemoteCommandSay{Message: message})
+}
+
+func (c *ConnectionRemote) Ping() {
+	c.sendOrPrint(RemoteCommandPing{})
+}
+
+func (c *ConnectionRemote) Kick(name, reason string) error {
+	return errors.New("kick is not supported in this mode")
+}
+
+func (c *ConnectionRemote) Leaderboard() map[string]int {
+	c.sendOrPrint(RemoteCommandScore{})
+	return nil
+}
+
+func (c *ConnectionRemote) Hint() {
+	c.boundsMu.Lock()
+	defer c.boundsMu.Unlock()
+	game.PrintOutf("try %d (valid range [%d, %d))", (c.lo+c.hi)/2, c.lo, c.hi)
+}
+
+func (c *ConnectionRemote) Stats() game.SessionStats {
+	c.sendOrPrint(RemoteCommandStats{})
+	return game.SessionStats{}
+}
+
+func (c *ConnectionRemote) Events() <-chan game.GameEvent {
+	return c.events
+}
+
+func (c *ConnectionRemote) Context() context.Context {
+	return c.sessionCtx
+}
+
+// endregion
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"number_guessing/game"
+	"number_guessing/protocol"
+	"number_guessing/server"
+)
+
+func TestRemoteSurvivesServerDeath(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+
+	// A minimal fake server: handshake, accept the join, then drop dead.
+	// net.Pipe is synchronous, so read the client's advertisement before
+	// writing ours.
+	go func() {
+		reader := bufio.NewReader(serverEnd)
+		if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+			return
+		}
+		if err := protocol.SendMagicAndProtoVer(serverEnd); err != nil {
+			return
+		}
+		if err := protocol.SendPacket(serverEnd, protocol.PacketAuthChallenge{}); err != nil {
+			return
+		}
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			return
+		}
+		join := packet.(protocol.PacketJoinAs)
+		_ = protocol.SendPacket(serverEnd, protocol.PacketJoinAs{Name: join.Name, Max: game.DefaultMaxNumber})
+		serverEnd.Close()
+	}()
+
+	conn, err := newConnectionRemote(clientEnd, "bob", 0, 0, protocol.RolePlayer, "", "")
+	if err != nil {
+		t.Fatalf("failed to join fake server: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !conn.RemoteStopped() {
+		if time.Now().After(deadline) {
+			t.Fatal("RemoteStopped never became true after the server died")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Commands after the loop exited must not hang.
+	finished := make(chan struct{})
+	go func() {
+		_, _ = conn.Guess(context.Background(), 5)
+		_ = conn.Stop()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Guess/Stop blocked on a dead connection")
+	}
+}
+
+func TestTLSWithSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	if err := writeSelfSignedCert(certFile, keyFile); err != nil {
+		t.Fatalf("failed to generate cert: %v", err)
+	}
+
+	serve, err := server.NewConnectionServeTLS("127.0.0.1:0", 2, server.ServeOptions{MaxNumber: game.DefaultMaxNumber}, certFile, keyFile)
+	if err != nil {
+		t.Fatalf("failed to serve TLS: %v", err)
+	}
+	t.Cleanup(func() { _ = serve.Stop() })
+	addr := serve.(*server.ConnectionServe).Addr()
+
+	// Trusting the self-signed cert as a CA verifies cleanly.
+	conn, err := NewConnectionRemoteTLSCA(addr, "tester", "127.0.0.1", certFile, false, TLSJoinOptions{})
+	if err != nil {
+		t.Fatalf("failed to join with CA trust: %v", err)
+	}
+	_ = conn.Stop()
+
+	// Without trust the handshake must fail instead of silently passing.
+	if _, err := NewConnectionRemoteTLS(addr, "tester", "127.0.0.1", false); err == nil {
+		t.Fatal("expected a certificate error without CA trust")
+	}
+}
+
+func writeSelfSignedCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	certOut, err := os.Create(certFile)
+	if err != nil {
+		return err
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyOut, err := os.Create(keyFile)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+	return pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,512 @@
+package game
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// region connection
+
+type Connection interface {
+	// Guess submits a guess. Synchronous implementations return the
+	// (possibly hard-mode-masked) result; ConnectionRemote returns the
+	// zero result and delivers the outcome through Events. The context
+	// bounds how long the call may wait for the session.
+	Guess(ctx context.Context, number int64) (GuessResult, error)
+	// Show reveals the current number and starts a new round, returning
+	// the revealed value where it is known synchronously.
+	Show(ctx context.Context) (int64, error)
+	// Restart picks a new number without revealing the old one.
+	Restart() error
+	Stop() error
+	// Context is done when the session can no longer be used.
+	Context() context.Context
+	RemoteStopped() bool
+	// Scores reports the session standings, delivered through Events.
+	Scores()
+	// Status reports whether the game is running and how many players are
+	// present.
+	Status()
+	// List reports who is connected to the session.
+	List()
+	// Stats returns session statistics. Remote connections return the
+	// zero value and deliver the server's answer through Events instead.
+	Stats() SessionStats
+	// Say sends a chat message to everyone in the session.
+	Say(message string)
+	// Ping reports connection latency: remote sessions measure a fresh
+	// round trip, the server prints the last keepalive measurements.
+	Ping()
+	// Kick ejects a player by name with an optional reason; only
+	// meaningful when serving.
+	Kick(name, reason string) error
+	// Hint suggests the optimal next guess from the remaining valid range.
+	Hint()
+	// Leaderboard returns rounds won per player; remote connections return
+	// nil and deliver the server's standings through Events instead.
+	Leaderboard() map[string]int
+	// Events exposes game events for the caller to observe; the main loop
+	// drains it and renders via GameEventToString.
+	Events() <-chan GameEvent
+}
+
+// EventBufferSize is the capacity of every Events() channel.
+const EventBufferSize = 32
+
+// region connection local
+
+type ConnectionLocal struct {
+	// mu guards the game state against the optional round timer firing
+	// concurrently with commands.
+	mu        sync.Mutex
+	number    int64
+	maxNumber int64
+	attempts  int
+	// attemptLimit ends the round as lost after that many wrong guesses.
+	// Zero means unlimited.
+	attemptLimit int
+	roundTimeout time.Duration
+	roundTimer   *time.Timer
+	warmth       bool
+	hardMode     bool
+	bestOf       int
+	matchWins    int
+	matchLosses  int
+	lo, hi       int64
+	rng          *rand.Rand
+	generator    NumberGenerator
+	events       chan GameEvent
+
+	rounds       int
+	totalGuesses int
+	correct      int
+	startedAt    time.Time
+}
+
+// LocalOptions carries the optional settings of a local game.
+type LocalOptions struct {
+	AttemptLimit int
+	// RoundTimeout reveals the number and restarts when a round drags on.
+	RoundTimeout time.Duration
+	Rng          *rand.Rand
+	// Generator overrides the secret number source; wins over Rng.
+	Generator NumberGenerator
+	// Warmth adds hot/warm/cold feedback to wrong guesses.
+	Warmth bool
+	// HardMode collapses direction feedback into a bare "wrong".
+	HardMode bool
+	// BestOf races the solo player against the attempt limit for up to N
+	// rounds; solved rounds are wins, exhausted ones losses.
+	BestOf int
+}
+
+func NewConnectionLocal(maxNumber int64, attemptLimit int) Connection {
+	return NewConnectionLocalOpts(maxNumber, LocalOptions{AttemptLimit: attemptLimit})
+}
+
+// NewConnectionLocalWithRand starts a local game drawing numbers from the
+// given source; nil selects a time-seeded one. A fixed seed makes the
+// number sequence across rounds reproducible.
+func NewConnectionLocalWithRand(maxNumber int64, attemptLimit int, rng *rand.Rand) Connection {
+	return NewConnectionLocalOpts(maxNumber, LocalOptions{AttemptLimit: attemptLimit, Rng: rng})
+}
+
+func NewConnectionLocalOpts(maxNumber int64, opts LocalOptions) Connection {
+	rng := opts.Rng
+	if rng == nil {
+		rng = NewDefaultRng()
+	}
+	conn := &ConnectionLocal{
+		maxNumber:    maxNumber,
+		attemptLimit: opts.AttemptLimit,
+		warmth:       opts.Warmth,
+		hardMode:     opts.HardMode,
+		bestOf:       opts.BestOf,
+		roundTimeout: opts.RoundTimeout,
+		rng:          rng,
+		generator:    opts.Generator,
+		events:       make(chan GameEvent, EventBufferSize),
+		startedAt:    time.Now(),
+	}
+	PrintOutf("local game started, range [0, %d)", maxNumber)
+	conn.NewGame()
+	return conn
+}
+
+// NewConnectionLocalWithLives starts a local game that ends as lost after
+// the given number of wrong guesses; zero lives means unlimited, matching
+// NewConnectionLocal.
+func NewConnectionLocalWithLives(maxNumber int64, lives int) Connection {
+	return NewConnectionLocal(maxNumber, lives)
+}
+
+// emit queues an event for the main loop, dropping it if the buffer is
+// somehow full so a local game can never block.
+func (c *ConnectionLocal) emit(event GameEvent) {
+	select {
+	case c.events <- event:
+	default:
+	}
+}
+
+func (c *ConnectionLocal) NewGame() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.newGameLocked()
+}
+
+func (c *ConnectionLocal) newGameLocked() {
+	if c.generator != nil {
+		n := c.generator.Next() % c.maxNumber
+		if n < 0 {
+			n += c.maxNumber
+		}
+		c.number = n
+	} else {
+		c.number = c.rng.Int63n(c.maxNumber)
+	}
+	c.attempts = 0
+	c.rounds++
+	c.lo, c.hi = 0, c.maxNumber
+	c.emit(GameEventGameNew{})
+	if c.roundTimeout > 0 {
+		if c.roundTimer != nil {
+			c.roundTimer.Stop()
+		}
+		round := c.rounds
+		c.roundTimer = time.AfterFunc(c.roundTimeout, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.rounds != round {
+				return
+			}
+			c.emit(GameEventGameTimeout{Number: c.number})
+			c.newGameLocked()
+		})
+	}
+}
+
+func (c *ConnectionLocal) Guess(ctx context.Context, number int64) (GuessResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
+	c.totalGuesses++
+	var result GuessResult
+	switch {
+	case number < c.number:
+		result = Lesser
+	case number > c.number:
+		result = Greater
+	default:
+		result = Equal
+	}
+	proximity := ""
+	if c.warmth && result != Equal {
+		proximity = ProximityBucket(number, c.number, c.maxNumber)
+	}
+	switch result {
+	case Lesser:
+		if number+1 > c.lo {
+			c.lo = number + 1
+		}
+	case Greater:
+		if number < c.hi {
+			c.hi = number
+		}
+	}
+	shown := result
+	if c.hardMode && result != Equal {
+		shown = Wrong
+		proximity = ""
+	}
+	c.emit(GameEventGameGuess{Name: "you", Number: number, Result: shown, Attempts: c.attempts, Proximity: proximity})
+	if result == Equal {
+		c.correct++
+		c.countMatchRound(true)
+		c.newGameLocked()
+		return shown, nil
+	}
+	if c.attemptLimit > 0 {
+		remaining := c.attemptLimit - c.attempts
+		if remaining <= 0 {
+			c.emit(GameEventGameLost{Name: "you", Number: c.number})
+			c.countMatchRound(false)
+			c.newGameLocked()
+			return shown, nil
+		}
+		c.emit(GameEventMessage{Text: fmt.Sprintf("%d attempts left", remaining)})
+	}
+	return shown, nil
+}
+
+// countMatchRound scores one solo round in a best-of match and announces
+// the outcome when either side reaches a majority.
+func (c *ConnectionLocal) countMatchRound(won bool) {
+	if c.bestOf <= 0 {
+		return
+	}
+	if won {
+		c.matchWins++
+	} else {
+		c.matchLosses++
+	}
+	majority := c.bestOf/2 + 1
+	switch {
+	case c.matchWins >= majority:
+		c.emit(GameEventMatchOver{Winner: "you", Wins: map[string]int{"you": c.matchWins, "the game": c.matchLosses}})
+	case c.matchLosses >= majority:
+		c.emit(GameEventMatchOver{Winner: "the game", Wins: map[string]int{"you": c.matchWins, "the game": c.matchLosses}})
+	default:
+		return
+	}
+	c.matchWins, c.matchLosses = 0, 0
+}
+
+func (c *ConnectionLocal) Show(ctx context.Context) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	number := c.number
+	c.emit(GameEventGameShow{Name: "you", Number: number})
+	c.newGameLocked()
+	return number, nil
+}
+
+// SetNumber replaces the secret with a chosen value; handy for testing.
+func (c *ConnectionLocal) SetNumber(number int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if number < 0 || number >= c.maxNumber {
+		return fmt.Errorf("number must be in [0, %d)", c.maxNumber)
+	}
+	c.newGameLocked()
+	c.number = number
+	return nil
+}
+
+func (c *ConnectionLocal) Restart() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.newGameLocked()
+	return nil
+}
+
+func (c *ConnectionLocal) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.roundTimer != nil {
+		c.roundTimer.Stop()
+	}
+	c.emit(GameEventGameStop{Reason: "local game over"})
+	return nil
+}
+
+func (c *ConnectionLocal) Scores() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	PrintOutf("current round: %d guesses", c.attempts)
+}
+
+func (c *ConnectionLocal) Status() {
+	PrintOut("local game, running")
+}
+
+func (c *ConnectionLocal) List() {
+	PrintOut("(local session)")
+}
+
+func (c *ConnectionLocal) Say(message string) {
+	c.emit(GameEventChat{From: "you", Message: message})
+}
+
+func (c *ConnectionLocal) Ping() {
+	PrintOut("local game, no network round trip")
+}
+
+func (c *ConnectionLocal) Kick(name, reason string) error {
+	return errors.New("kick is not supported in this mode")
+}
+
+func (c *ConnectionLocal) Leaderboard() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]int{"you": c.correct}
+}
+
+func (c *ConnectionLocal) Hint() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	PrintOutf("try %d (valid range [%d, %d))", (c.lo+c.hi)/2, c.lo, c.hi)
+}
+
+func (c *ConnectionLocal) Stats() SessionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := SessionStats{
+		Rounds:         c.rounds,
+		TotalGuesses:   c.totalGuesses,
+		CorrectGuesses: c.correct,
+		StartedAt:      c.startedAt,
+	}
+	if stats.Rounds > 0 {
+		stats.AvgGuesses = float64(stats.TotalGuesses) / float64(stats.Rounds)
+	}
+	return stats
+}
+
+func (c *ConnectionLocal) Events() <-chan GameEvent {
+	return c.events
+}
+
+func (c *ConnectionLocal) Context() context.Context {
+	return context.Background()
+}
+
+func (c *ConnectionLocal) RemoteStopped() bool {
+	return false
+}
+
+// endregion
+
+// region connection hotseat
+
+// ConnectionHotseat lets several people share one terminal: every guess
+// is attributed to the player whose turn it is and the turn advances
+// after each guess.
+type ConnectionHotseat struct {
+	number    int64
+	maxNumber int64
+	names     []string
+	turn      int
+	wins      map[string]int
+	attempts  map[string]int
+	rng       *rand.Rand
+	events    chan GameEvent
+}
+
+func NewConnectionHotseat(names []string, max int64) Connection {
+	conn := &ConnectionHotseat{
+		maxNumber: max,
+		names:     names,
+		wins:      make(map[string]int),
+		attempts:  make(map[string]int),
+		rng:       NewDefaultRng(),
+		events:    make(chan GameEvent, EventBufferSize),
+	}
+	PrintOutf("hotseat game with %s, range [0, %d)", strings.Join(names, ", "), max)
+	conn.newGame()
+	return conn
+}
+
+func (c *ConnectionHotseat) emit(event GameEvent) {
+	select {
+	case c.events <- event:
+	default:
+	}
+}
+
+func (c *ConnectionHotseat) newGame() {
+	c.number = c.rng.Int63n(c.maxNumber)
+	c.attempts = make(map[string]int)
+	c.emit(GameEventGameNew{})
+	c.emit(GameEventTurnChange{PlayerName: c.names[c.turn]})
+}
+
+func (c *ConnectionHotseat) Guess(ctx context.Context, number int64) (GuessResult, error) {
+	name := c.names[c.turn]
+	c.attempts[name]++
+	var result GuessResult
+	switch {
+	case number < c.number:
+		result = Lesser
+	case number > c.number:
+		result = Greater
+	default:
+		result = Equal
+	}
+	c.emit(GameEventGameGuess{Name: name, Number: number, Result: result, Attempts: c.attempts[name]})
+	c.turn = (c.turn + 1) % len(c.names)
+	if result == Equal {
+		c.wins[name]++
+		c.emit(GameEventRoundEnd{Winner: name, Guesses: c.attempts})
+		c.newGame()
+		return result, nil
+	}
+	c.emit(GameEventTurnChange{PlayerName: c.names[c.turn]})
+	return result, nil
+}
+
+func (c *ConnectionHotseat) Show(ctx context.Context) (int64, error) {
+	number := c.number
+	c.emit(GameEventGameShow{Name: c.names[c.turn], Number: number})
+	c.newGame()
+	return number, nil
+}
+
+func (c *ConnectionHotseat) Restart() error {
+	c.newGame()
+	return nil
+}
+
+func (c *ConnectionHotseat) Stop() error {
+	PrintOut("final " + FormatScoreboard(c.wins))
+	return nil
+}
+
+func (c *ConnectionHotseat) RemoteStopped() bool {
+	return false
+}
+
+func (c *ConnectionHotseat) Scores() {
+	PrintOut(FormatScoreboard(c.wins))
+}
+
+func (c *ConnectionHotseat) Status() {
+	PrintOutf("hotseat game, it's %s's turn", c.names[c.turn])
+}
+
+func (c *ConnectionHotseat) List() {
+	PrintOutf("players: %s", strings.Join(c.names, ", "))
+}
+
+func (c *ConnectionHotseat) Stats() SessionStats {
+	return SessionStats{}
+}
+
+func (c *ConnectionHotseat) Say(message string) {
+	c.emit(GameEventChat{From: c.names[c.turn], Message: message})
+}
+
+func (c *ConnectionHotseat) Ping() {
+	PrintOut("hotseat game, no network round trip")
+}
+
+func (c *ConnectionHotseat) Kick(name, reason string) error {
+	return errors.New("kick is not supported in this mode")
+}
+
+func (c *ConnectionHotseat) Leaderboard() map[string]int {
+	wins := make(map[string]int, len(c.wins))
+	for name, count := range c.wins {
+		wins[name] = count
+	}
+	return wins
+}
+
+func (c *ConnectionHotseat) Hint() {
+	PrintOutf("try %d", c.maxNumber/2)
+}
+
+func (c *ConnectionHotseat) Events() <-chan GameEvent {
+	return c.events
+}
+
+func (c *ConnectionHotseat) Context() context.Context {
+	return context.Background()
+}
+
+// endregion
@@ -0,0 +1,581 @@
+package game
+
+import (
+	crand "crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultMaxNumber int64 = 100
+
+// RecordedEvent is one line of a recorded game session: a timestamp, the
+// event type tag, and the event fields.
+type RecordedEvent struct {
+	Ts   time.Time       `json:"ts"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// gameEventTypeName tags each event type for the JSON log.
+func gameEventTypeName(event GameEvent) string {
+	switch event.(type) {
+	case GameEventPlayerJoin:
+		return "PlayerJoin"
+	case GameEventPlayerQuit:
+		return "PlayerQuit"
+	case GameEventGameNew:
+		return "GameNew"
+	case GameEventGameStop:
+		return "GameStop"
+	case GameEventGameGuess:
+		return "GameGuess"
+	case GameEventGameShow:
+		return "GameShow"
+	case GameEventGameLost:
+		return "GameLost"
+	case GameEventTurnChange:
+		return "TurnChange"
+	case GameEventSpectatorJoin:
+		return "SpectatorJoin"
+	case GameEventSpectatorLeave:
+		return "SpectatorLeave"
+	case GameEventGameTimeout:
+		return "GameTimeout"
+	case GameEventMatchOver:
+		return "MatchOver"
+	case GameEventRoundEnd:
+		return "RoundEnd"
+	case GameEventScoreboard:
+		return "Scoreboard"
+	case GameEventChat:
+		return "Chat"
+	case GameEventMessage:
+		return "Message"
+	}
+	return ""
+}
+
+// MarshalGameEvent encodes one event as a JSON log line (no trailing
+// newline).
+func MarshalGameEvent(ts time.Time, event GameEvent) ([]byte, error) {
+	name := gameEventTypeName(event)
+	if name == "" {
+		return nil, fmt.Errorf("unrecordable game event %T", event)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(RecordedEvent{Ts: ts, Type: name, Data: data})
+}
+
+// UnmarshalGameEvent decodes a line written by MarshalGameEvent.
+func UnmarshalGameEvent(line []byte) (time.Time, GameEvent, error) {
+	var rec RecordedEvent
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return time.Time{}, nil, err
+	}
+	var event GameEvent
+	switch rec.Type {
+	case "PlayerJoin":
+		event = &GameEventPlayerJoin{}
+	case "PlayerQuit":
+		event = &GameEventPlayerQuit{}
+	case "GameNew":
+		event = &GameEventGameNew{}
+	case "GameStop":
+		event = &GameEventGameStop{}
+	case "GameGuess":
+		event = &GameEventGameGuess{}
+	case "GameShow":
+		event = &GameEventGameShow{}
+	case "GameLost":
+		event = &GameEventGameLost{}
+	case "TurnChange":
+		event = &GameEventTurnChange{}
+	case "SpectatorJoin":
+		event = &GameEventSpectatorJoin{}
+	case "SpectatorLeave":
+		event = &GameEventSpectatorLeave{}
+	case "GameTimeout":
+		event = &GameEventGameTimeout{}
+	case "MatchOver":
+		event = &GameEventMatchOver{}
+	case "RoundEnd":
+		event = &GameEventRoundEnd{}
+	case "Scoreboard":
+		event = &GameEventScoreboard{}
+	case "Chat":
+		event = &GameEventChat{}
+	case "Message":
+		event = &GameEventMessage{}
+	default:
+		return time.Time{}, nil, fmt.Errorf("unknown recorded event type %q", rec.Type)
+	}
+	if err := json.Unmarshal(rec.Data, event); err != nil {
+		return time.Time{}, nil, err
+	}
+	// Events travel by value everywhere else; unwrap the pointer used for
+	// unmarshalling.
+	switch e := event.(type) {
+	case *GameEventPlayerJoin:
+		return rec.Ts, *e, nil
+	case *GameEventPlayerQuit:
+		return rec.Ts, *e, nil
+	case *GameEventGameNew:
+		return rec.Ts, *e, nil
+	case *GameEventGameStop:
+		return rec.Ts, *e, nil
+	case *GameEventGameGuess:
+		return rec.Ts, *e, nil
+	case *GameEventGameShow:
+		return rec.Ts, *e, nil
+	case *GameEventGameLost:
+		return rec.Ts, *e, nil
+	case *GameEventTurnChange:
+		return rec.Ts, *e, nil
+	case *GameEventSpectatorJoin:
+		return rec.Ts, *e, nil
+	case *GameEventSpectatorLeave:
+		return rec.Ts, *e, nil
+	case *GameEventGameTimeout:
+		return rec.Ts, *e, nil
+	case *GameEventMatchOver:
+		return rec.Ts, *e, nil
+	case *GameEventRoundEnd:
+		return rec.Ts, *e, nil
+	case *GameEventScoreboard:
+		return rec.Ts, *e, nil
+	case *GameEventChat:
+		return rec.Ts, *e, nil
+	case *GameEventMessage:
+		return rec.Ts, *e, nil
+	}
+	return rec.Ts, nil, fmt.Errorf("unhandled recorded event type %q", rec.Type)
+}
+
+// ProximityBucket grades how close a wrong guess was relative to the
+// guessing range.
+func ProximityBucket(guess, number, max int64) string {
+	diff := guess - number
+	if diff < 0 {
+		diff = -diff
+	}
+	switch {
+	case diff*16 <= max:
+		return "hot"
+	case diff*4 <= max:
+		return "warm"
+	default:
+		return "cold"
+	}
+}
+
+// NewDefaultRng builds the time-seeded source used when the caller does
+// not inject one.
+func NewDefaultRng() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// NumberGenerator produces the secret numbers of a session, letting the
+// random source be swapped wholesale.
+type NumberGenerator interface {
+	Next() int64
+}
+
+// DefaultGenerator draws uniformly from [0, Max) with the global source.
+type DefaultGenerator struct {
+	Max int64
+}
+
+func (g DefaultGenerator) Next() int64 {
+	return rand.Int63n(g.Max)
+}
+
+// FixedGenerator always returns the same number; useful for tests.
+type FixedGenerator struct {
+	Value int64
+}
+
+func (g FixedGenerator) Next() int64 {
+	return g.Value
+}
+
+// SequentialGenerator returns Start, Start+Step, Start+2*Step, …
+type SequentialGenerator struct {
+	Start, Step int64
+	current     int64
+	started     bool
+}
+
+func (g *SequentialGenerator) Next() int64 {
+	if !g.started {
+		g.started = true
+		g.current = g.Start
+		return g.current
+	}
+	g.current += g.Step
+	return g.current
+}
+
+// CryptoGenerator draws from [0, Max) using crypto/rand.
+type CryptoGenerator struct {
+	Max int64
+}
+
+func (g CryptoGenerator) Next() int64 {
+	n, err := crand.Int(crand.Reader, big.NewInt(g.Max))
+	if err != nil {
+		return 0
+	}
+	return n.Int64()
+}
+
+// ParseGenerator builds a NumberGenerator from a CLI spec:
+// "fixed:<n>", "sequential:<start>:<step>", or "crypto".
+func ParseGenerator(spec string, max int64) (NumberGenerator, error) {
+	parts := strings.Split(spec, ":")
+	switch parts[0] {
+	case "fixed":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("usage: fixed:<n>")
+		}
+		value, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || value < 0 || value >= max {
+			return nil, fmt.Errorf("fixed value must be in [0, %d)", max)
+		}
+		return FixedGenerator{Value: value}, nil
+	case "sequential":
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("usage: sequential:<start>:<step>")
+		}
+		start, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start %q", parts[1])
+		}
+		step, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid step %q", parts[2])
+		}
+		return &SequentialGenerator{Start: start, Step: step}, nil
+	case "crypto":
+		return CryptoGenerator{Max: max}, nil
+	}
+	return nil, fmt.Errorf("unknown generator %q (fixed:<n>, sequential:<s>:<d>, crypto)", spec)
+}
+
+// region guess result
+
+type GuessResult uint8
+
+const (
+	Lesser GuessResult = iota
+	Greater
+	Equal
+	// Wrong replaces Lesser/Greater in hard mode, hiding the direction.
+	Wrong
+)
+
+func (r GuessResult) String() string {
+	switch r {
+	case Lesser:
+		return "lesser"
+	case Greater:
+		return "greater"
+	case Equal:
+		return "equal"
+	case Wrong:
+		return "wrong"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(r))
+}
+
+// ANSI escape codes used by the optional color output.
+const (
+	ansiReset  = "\033[0m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiCyan   = "\033[36m"
+)
+
+var colorEnabled bool
+
+// SetColorEnabled toggles ANSI colors on all result and event rendering.
+func SetColorEnabled(on bool) {
+	colorEnabled = on
+}
+
+func colorize(code, msg string) string {
+	if !colorEnabled {
+		return msg
+	}
+	return code + msg + ansiReset
+}
+
+// ColorizeEvent wraps a rendered event line in the color matching its
+// kind: green for wins, yellow/red for direction feedback, cyan for
+// session events, plain for chat.
+func ColorizeEvent(event GameEvent, msg string) string {
+	switch e := event.(type) {
+	case GameEventGameGuess:
+		switch e.Result {
+		case Equal:
+			return colorize(ansiGreen, msg)
+		case Lesser:
+			return colorize(ansiYellow, msg)
+		case Greater, Wrong:
+			return colorize(ansiRed, msg)
+		}
+	case GameEventChat:
+		return msg
+	case GameEventPlayerJoin, GameEventPlayerQuit, GameEventGameNew, GameEventGameStop, GameEventGameShow, GameEventTurnChange, GameEventMessage:
+		return colorize(ansiCyan, msg)
+	}
+	return msg
+}
+
+func PrintCorrect() {
+	PrintOut(colorize(ansiGreen, "correct!"))
+}
+
+func PrintCorrectIn(attempts int) {
+	PrintOut(colorize(ansiGreen, fmt.Sprintf("correct! solved in %d guesses", attempts)))
+}
+
+func PrintLost(number int64) {
+	PrintOut(colorize(ansiRed, fmt.Sprintf("out of attempts! the number was %d", number)))
+}
+
+func PrintLesser() {
+	PrintOut(colorize(ansiYellow, "too small!"))
+}
+
+func PrintGreater() {
+	PrintOut(colorize(ansiRed, "too big!"))
+}
+
+func PrintWrong() {
+	PrintOut(colorize(ansiRed, "wrong!"))
+}
+
+// endregion
+
+// region game event
+
+type GameEvent interface{}
+
+type GameEventPlayerJoin struct {
+	Name string
+	// Spectator marks joiners who only watch.
+	Spectator bool
+}
+
+type GameEventPlayerQuit struct {
+	Name string
+}
+
+type GameEventGameNew struct{}
+
+type GameEventGameStop struct {
+	Reason string
+}
+
+type GameEventGameGuess struct {
+	Name   string
+	Number int64
+	Result GuessResult
+	// Attempts is the player's guess count in the current round,
+	// including this guess.
+	Attempts int
+	// Proximity is the optional warmth bucket ("hot"/"warm"/"cold") when
+	// the session plays with warmth feedback; empty otherwise.
+	Proximity string
+}
+
+type GameEventGameShow struct {
+	Name   string
+	Number int64
+}
+
+type GameEventGameLost struct {
+	Name   string
+	Number int64
+}
+
+type GameEventTurnChange struct {
+	PlayerName string
+}
+
+// GameEventChat is a chat line from a player, rendered "[from] message".
+type GameEventChat struct {
+	From    string
+	Message string
+}
+
+// GameEventMessage carries free-form text relayed from a remote server.
+type GameEventMessage struct {
+	Text string
+}
+
+type GameEventScoreboard struct {
+	Scores map[string]int
+}
+
+// GameEventSpectatorJoin and GameEventSpectatorLeave tell the players —
+// not other spectators — who is watching.
+type GameEventSpectatorJoin struct {
+	Name string
+}
+
+type GameEventSpectatorLeave struct {
+	Name string
+}
+
+// GameEventGameTimeout reveals the number when a round timer expires
+// before anyone guesses it.
+type GameEventGameTimeout struct {
+	Number int64
+}
+
+// GameEventMatchOver announces a best-of-N match winner with the final
+// per-player round wins.
+type GameEventMatchOver struct {
+	Winner string
+	Wins   map[string]int
+}
+
+type GameEventRoundEnd struct {
+	Winner string
+	// Round is the 1-based number of the round that just ended.
+	Round int
+	// Guesses maps each player to the number of guesses they submitted
+	// during the round.
+	Guesses map[string]int
+}
+
+func GameEventToString(event GameEvent) string {
+	switch e := event.(type) {
+	case GameEventPlayerJoin:
+		if e.Spectator {
+			return fmt.Sprintf("%s joined the game (spectator)", e.Name)
+		}
+		return fmt.Sprintf("%s joined the game", e.Name)
+	case GameEventPlayerQuit:
+		return fmt.Sprintf("%s left the game", e.Name)
+	case GameEventGameNew:
+		return "new game started"
+	case GameEventGameStop:
+		return fmt.Sprintf("game stopped, %s", e.Reason)
+	case GameEventGameGuess:
+		switch e.Result {
+		case Equal:
+			if e.Attempts == 0 {
+				return fmt.Sprintf("%s guessed %d, correct!", e.Name, e.Number)
+			}
+			return fmt.Sprintf("%s guessed %d, correct in %d tries!", e.Name, e.Number, e.Attempts)
+		case Wrong:
+			return fmt.Sprintf("%s guessed %d, wrong!", e.Name, e.Number)
+		case Lesser, Greater:
+			direction := "too small!"
+			if e.Result == Greater {
+				direction = "too big!"
+			}
+			if e.Proximity != "" {
+				return fmt.Sprintf("%s guessed %d, %s (%s)", e.Name, e.Number, direction, e.Proximity)
+			}
+			return fmt.Sprintf("%s guessed %d, %s", e.Name, e.Number, direction)
+		}
+		return fmt.Sprintf("%s guessed %d (%s)", e.Name, e.Number, e.Result)
+	case GameEventGameShow:
+		return fmt.Sprintf("%s revealed the number %d", e.Name, e.Number)
+	case GameEventGameLost:
+		return fmt.Sprintf("%s ran out of attempts, the number was %d", e.Name, e.Number)
+	case GameEventTurnChange:
+		return fmt.Sprintf("it's %s's turn", e.PlayerName)
+	case GameEventScoreboard:
+		return FormatScoreboard(e.Scores)
+	case GameEventMessage:
+		return fmt.Sprintf("[Server] %s", e.Text)
+	case GameEventChat:
+		return fmt.Sprintf("[%s] %s", e.From, e.Message)
+	case GameEventSpectatorJoin:
+		return fmt.Sprintf("%s is now watching", e.Name)
+	case GameEventSpectatorLeave:
+		return fmt.Sprintf("%s stopped watching", e.Name)
+	case GameEventGameTimeout:
+		return fmt.Sprintf("time's up! the number was %d", e.Number)
+	case GameEventMatchOver:
+		return fmt.Sprintf("%s wins the match! final %s", e.Winner, FormatScoreboard(e.Wins))
+	case GameEventRoundEnd:
+		others := make([]string, 0, len(e.Guesses))
+		for name, guesses := range e.Guesses {
+			if name != e.Winner && guesses > 0 {
+				others = append(others, fmt.Sprintf("%s: %d", name, guesses))
+			}
+		}
+		sort.Strings(others)
+		msg := fmt.Sprintf("%s won in %d guesses", e.Winner, e.Guesses[e.Winner])
+		if e.Round > 0 {
+			msg = fmt.Sprintf("round %d ended — %s", e.Round, msg)
+		}
+		if len(others) > 0 {
+			msg = fmt.Sprintf("%s (%s)", msg, strings.Join(others, ", "))
+		}
+		return msg
+	}
+	return fmt.Sprintf("unrenderable game event %T", event)
+}
+
+// SessionStats aggregates what happened since a session started.
+type SessionStats struct {
+	Rounds         int
+	TotalGuesses   int
+	CorrectGuesses int
+	// AvgGuesses is guesses per round, zero when no round finished.
+	AvgGuesses float64
+	StartedAt  time.Time
+}
+
+// formatStats renders session statistics as a small table.
+func FormatStats(stats SessionStats) string {
+	return fmt.Sprintf(
+		"rounds played:     %d\nguesses submitted: %d\ncorrect guesses:   %d\navg per round:     %.1f\nstarted:           %s\n",
+		stats.Rounds,
+		stats.TotalGuesses,
+		stats.CorrectGuesses,
+		stats.AvgGuesses,
+		stats.StartedAt.Format("15:04:05"),
+	)
+}
+
+// FormatScoreboard renders win counts ordered by score with ties listed
+// alphabetically.
+func FormatScoreboard(scores map[string]int) string {
+	names := make([]string, 0, len(scores))
+	for name := range scores {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if scores[names[i]] != scores[names[j]] {
+			return scores[names[i]] > scores[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %d", name, scores[name]))
+	}
+	if len(parts) == 0 {
+		return "scores: (none)"
+	}
+	return "scores: " + strings.Join(parts, ", ")
+}
+
+// endregion
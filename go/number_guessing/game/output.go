@@ -0,0 +1,27 @@
+package game
+
+import "fmt"
+
+// OutputSink receives every user-facing line the library produces.
+// Swapping Printer lets a frontend re-route or re-encode output (the CLI
+// uses it for its JSON mode) without touching the game logic.
+type OutputSink interface {
+	Println(msg string)
+}
+
+type humanSink struct{}
+
+func (humanSink) Println(msg string) {
+	fmt.Println(msg)
+}
+
+// Printer is the active output sink; defaults to plain stdout lines.
+var Printer OutputSink = humanSink{}
+
+func PrintOut(msg string) {
+	Printer.Println(msg)
+}
+
+func PrintOutf(format string, args ...any) {
+	Printer.Println(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,3 @@
+module number_guessing
+
+go 1.21
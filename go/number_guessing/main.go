@@ -0,0 +1,1387 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"number_guessing/client"
+	"number_guessing/game"
+	"number_guessing/protocol"
+	"number_guessing/server"
+)
+
+// region command
+
+type Command interface{}
+
+type CommandLocal struct {
+	MaxNumber    int64
+	AttemptLimit int
+	Warmth       bool
+	Hard         bool
+	BestOf       int
+	RoundTimeout time.Duration
+	Rng          *rand.Rand
+}
+
+type CommandServe struct {
+	Host        string
+	PlayerCount uint
+	Opts        server.ServeOptions
+}
+
+type CommandConnect struct {
+	Host     string
+	Name     string
+	Timeout  time.Duration
+	Retries  int
+	Password string
+	Room     string
+}
+
+type CommandSpectate struct {
+	Host     string
+	Name     string
+	Password string
+	Room     string
+}
+
+type CommandServeUnix struct {
+	Path        string
+	PlayerCount uint
+}
+
+type CommandConnectUnix struct {
+	Path string
+	Name string
+}
+
+type CommandServeTLS struct {
+	Host        string
+	PlayerCount uint
+	Opts        server.ServeOptions
+	CertFile    string
+	KeyFile     string
+}
+
+type CommandConnectTLS struct {
+	Host     string
+	Name     string
+	Insecure bool
+	CAFile   string
+	Timeout  time.Duration
+	Retries  int
+	Password string
+	Room     string
+}
+
+type CommandGuess struct {
+	Number int64
+}
+
+type CommandShow struct{}
+
+type CommandScores struct{}
+
+type CommandStatus struct{}
+
+type CommandList struct{}
+
+type CommandStats struct{}
+
+type CommandSay struct {
+	Message string
+}
+
+type CommandDiscover struct{}
+
+type CommandPing struct{}
+
+type CommandKick struct {
+	Name   string
+	Reason string
+}
+
+type CommandHotseat struct {
+	Names     []string
+	MaxNumber int64
+}
+
+type CommandRooms struct{}
+
+type CommandJSON struct{}
+
+type CommandHint struct{}
+
+type CommandRestart struct{}
+
+type CommandMotd struct {
+	Text string
+}
+
+type CommandSet struct {
+	Number int64
+}
+
+type CommandRecord struct {
+	Path string
+}
+
+type CommandReplay struct {
+	Path  string
+	Speed float64
+}
+
+type CommandStop struct{}
+
+type CommandHelp struct{}
+
+type CommandQuit struct{}
+
+// endregion
+
+func printHelp() {
+	fmt.Print(`commands:
+  local [range] [--limit N]    start a local game, range defaults to 100
+                               (--lives N is an alias for --limit N,
+                               --seed N makes the numbers reproducible)
+  hotseat <n1> <n2> [...]      multiple players on one terminal
+  serve <host> [count] [range] host a game, e.g. serve :8080 2 500
+        [--limit N]            end a round as lost after N wrong guesses
+        [--turn-based]         players guess one at a time in join order
+        [--timeout D]          network send timeout, 0 disables
+        [--idle-timeout D]     kick players idle for longer than D
+        [--ping-interval D]    keepalive ping cadence, default 30s
+        [--spectators N]       cap the number of spectators
+        [--scores <file>]      persist win counts across restarts
+        [--seed N]             deterministic number sequence
+        [--http <addr>]        REST endpoint for state inspection
+        [--password <pw>]      require a password to join
+        [--warmth]             add hot/warm/cold feedback (also for
+                               local)
+        [--migrate]            keep serving remaining players after stop
+        [--generator <spec>]   fixed:<n>, sequential:<s>:<d>, crypto
+        [--mode hard]          no direction hints (also for local)
+        [--best-of N]          announce a match winner at a majority
+        [--metrics <addr>]     Prometheus metrics at /metrics
+        [--round-timeout D]    reveal and restart if nobody wins in time
+        [--host-only-reveal]   only the host may show or restart
+        [--motd <text>]        greet joining players (motd command
+                               updates it live)
+        [--logfile <path>]     append game events to a rotated log
+        [--logmax-mb N]        rotation threshold, default 10
+        [--rate N/D]           limit guesses, e.g. 1/2s per player
+        [--tls <cert> <key>]   serve over TLS
+        [--history-size N]     replay N recent events on join
+        [--guess-timeout D]    skip stalled turns (turn-based mode)
+  connect <host> [name] [timeout] [--retry N] [--password <pw>]
+          [--room <name>] [--tls] [--ca <file>] [--insecure]
+                               join a hosted game, retrying dropped
+                               connections up to N times
+  spectate <host> [name]       watch a hosted game without playing
+  serve-unix <path> [count]    host a game on a unix socket
+  connect-unix <path> [name]   join a unix socket game
+  serve-tls <host> <count> <cert> <key>
+                               host a game over TLS
+  connect-tls <host> [name] [--insecure]
+                               join a TLS hosted game
+  <number>                     guess the number
+  show                         reveal the number and start a new game
+  restart                      new round without revealing the number
+  set <number>                 host-picked secret (setter can't guess)
+  score                        print the session standings
+  status                       show player count and game state
+  list / players               list connected players
+  stats                        print per-session statistics
+  say <message>                chat with everyone in the session
+  discover                     find servers on the local network
+                               (then: connect #1 [name])
+  rooms                        list rooms on the served session
+  json                         toggle line-delimited JSON output
+  record <path>                append game events to a JSON log
+  replay <path> [speed]        play a recorded log back
+  ping                         measure connection latency
+  kick <name> [reason]         eject a player (server only)
+  hint                         suggest the optimal next guess
+  stop                         stop the current session
+  help                         print this message
+  quit                         exit
+
+startup flags: --json-log, --color/--no-color, --script <file>, and the
+stream modes --framed/--sequenced. The stream modes change the wire
+layout, so every peer must start with the same combination; such builds
+advertise only their own protocol version and refuse plain peers.
+`)
+}
+
+// takeFlag removes a bare "<flag>" from args, reporting whether it was
+// present.
+func takeFlag(args []string, flag string) ([]string, bool) {
+	for i, arg := range args {
+		if arg == flag {
+			return append(append([]string{}, args[:i]...), args[i+1:]...), true
+		}
+	}
+	return args, false
+}
+
+// takeFlagValue removes "<flag> <value>" from args, returning the remaining
+// args and the value. found is true when the flag was present, even if its
+// value is missing.
+func takeFlagValue(args []string, flag string) (rest []string, value string, found bool) {
+	for i, arg := range args {
+		if arg != flag {
+			continue
+		}
+		rest = append(append([]string{}, args[:i]...), args[i+1:]...)
+		if i < len(rest) {
+			value = rest[i]
+			rest = append(rest[:i], rest[i+1:]...)
+		}
+		return rest, value, true
+	}
+	return args, "", false
+}
+
+// parseAttemptLimit parses a "--limit N" (or its "--lives N" alias) flag
+// out of args. A limit of zero (or an absent flag) means unlimited
+// attempts.
+func parseAttemptLimit(args []string) ([]string, int, error) {
+	args, value, found := takeFlagValue(args, "--limit")
+	if !found {
+		args, value, found = takeFlagValue(args, "--lives")
+	}
+	if !found {
+		return args, 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return args, 0, fmt.Errorf("invalid attempt limit %q", value)
+	}
+	return args, limit, nil
+}
+
+// parseBestOf parses a "--best-of N" flag; N must be odd so a majority
+// exists.
+func parseBestOf(args []string) ([]string, int, error) {
+	args, value, found := takeFlagValue(args, "--best-of")
+	if !found {
+		return args, 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n%2 == 0 {
+		return args, 0, fmt.Errorf("best-of must be a positive odd number, got %q", value)
+	}
+	return args, n, nil
+}
+
+// parseMode parses "--mode hard" (or "--mode normal", the default).
+func parseMode(args []string) ([]string, bool, error) {
+	args, value, found := takeFlagValue(args, "--mode")
+	if !found {
+		return args, false, nil
+	}
+	switch value {
+	case "hard":
+		return args, true, nil
+	case "normal":
+		return args, false, nil
+	}
+	return args, false, fmt.Errorf("unknown mode %q (hard or normal)", value)
+}
+
+// parseTimeout parses a network timeout argument. "0" disables play-phase
+// deadlines, reported as a negative duration internally.
+func parseTimeout(arg string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(arg)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", arg)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("timeout must not be negative, got %s", arg)
+	}
+	if timeout == 0 {
+		return -1, nil
+	}
+	return timeout, nil
+}
+
+// parseRange parses an optional guessing range argument, rejecting
+// ranges that leave fewer than two possible numbers.
+func parseRange(arg string) (int64, error) {
+	max, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range %q", arg)
+	}
+	if max < 2 {
+		return 0, fmt.Errorf("range must be at least 2, got %d", max)
+	}
+	return max, nil
+}
+
+func parseCommand(input string) (Command, error) {
+	args := strings.Split(input, " ")
+	switch args[0] {
+	case "say", "chat":
+		// Preserve spacing in the message instead of re-joining split args.
+		message := strings.TrimSpace(strings.TrimPrefix(input, args[0]))
+		if message == "" {
+			return nil, fmt.Errorf("usage: %s <message>", args[0])
+		}
+		if len(message) > 256 {
+			return nil, errors.New("message too long (max 256 bytes)")
+		}
+		return CommandSay{Message: message}, nil
+	case "local":
+		var localRng *rand.Rand
+		if rest, value, found := takeFlagValue(args, "--seed"); found {
+			args = rest
+			seed, errS := strconv.ParseInt(value, 10, 64)
+			if errS != nil {
+				return nil, fmt.Errorf("invalid seed %q", value)
+			}
+			localRng = rand.New(rand.NewSource(seed))
+		}
+		var roundTimeout time.Duration
+		if rest, value, found := takeFlagValue(args, "--round-timeout"); found {
+			args = rest
+			var errT error
+			if roundTimeout, errT = time.ParseDuration(value); errT != nil || roundTimeout <= 0 {
+				return nil, fmt.Errorf("invalid round timeout %q", value)
+			}
+		}
+		args, hard, err0 := parseMode(args)
+		if err0 != nil {
+			return nil, err0
+		}
+		args, bestOf, err0 := parseBestOf(args)
+		if err0 != nil {
+			return nil, err0
+		}
+		args, warmth := takeFlag(args, "--warmth")
+		args, limit, err := parseAttemptLimit(args)
+		if err != nil {
+			return nil, err
+		}
+		max := game.DefaultMaxNumber
+		if len(args) >= 2 {
+			if max, err = parseRange(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		return CommandLocal{MaxNumber: max, AttemptLimit: limit, Warmth: warmth, Hard: hard, BestOf: bestOf, RoundTimeout: roundTimeout, Rng: localRng}, nil
+	case "rooms":
+		return CommandRooms{}, nil
+	case "json":
+		return CommandJSON{}, nil
+	case "hint":
+		return CommandHint{}, nil
+	case "restart":
+		return CommandRestart{}, nil
+	case "set":
+		if len(args) < 2 {
+			return nil, errors.New("usage: set <number>")
+		}
+		number, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", args[1])
+		}
+		return CommandSet{Number: number}, nil
+	case "motd":
+		text := strings.TrimSpace(strings.TrimPrefix(input, "motd"))
+		if text == "" {
+			return nil, errors.New("usage: motd <text>")
+		}
+		return CommandMotd{Text: text}, nil
+	case "record":
+		if len(args) < 2 {
+			return nil, errors.New("usage: record <path>")
+		}
+		return CommandRecord{Path: args[1]}, nil
+	case "replay":
+		if len(args) < 2 {
+			return nil, errors.New("usage: replay <path> [speed]")
+		}
+		speed := 1.0
+		if len(args) >= 3 {
+			var err error
+			if speed, err = strconv.ParseFloat(args[2], 64); err != nil || speed <= 0 {
+				return nil, fmt.Errorf("invalid replay speed %q", args[2])
+			}
+		}
+		return CommandReplay{Path: args[1], Speed: speed}, nil
+	case "hotseat":
+		if len(args) < 3 {
+			return nil, errors.New("usage: hotseat <name1> <name2> [more names]")
+		}
+		return CommandHotseat{Names: args[1:], MaxNumber: game.DefaultMaxNumber}, nil
+	case "serve":
+		var tlsCert, tlsKey string
+		for i, arg := range args {
+			if arg == "--tls" {
+				if i+2 >= len(args) {
+					return nil, errors.New("--tls needs <cert> <key>")
+				}
+				tlsCert, tlsKey = args[i+1], args[i+2]
+				args = append(append([]string{}, args[:i]...), args[i+3:]...)
+				break
+			}
+		}
+		args, hostOnlyReveal := takeFlag(args, "--host-only-reveal")
+		var roundTimeout, guessTimeout time.Duration
+		if rest, value, found := takeFlagValue(args, "--round-timeout"); found {
+			args = rest
+			var errT error
+			if roundTimeout, errT = time.ParseDuration(value); errT != nil || roundTimeout <= 0 {
+				return nil, fmt.Errorf("invalid round timeout %q", value)
+			}
+		}
+		if rest, value, found := takeFlagValue(args, "--guess-timeout"); found {
+			args = rest
+			var errT error
+			if guessTimeout, errT = time.ParseDuration(value); errT != nil || guessTimeout <= 0 {
+				return nil, fmt.Errorf("invalid guess timeout %q", value)
+			}
+		}
+		args, hard, errMode := parseMode(args)
+		if errMode != nil {
+			return nil, errMode
+		}
+		args, bestOf, errMode := parseBestOf(args)
+		if errMode != nil {
+			return nil, errMode
+		}
+		args, migrate := takeFlag(args, "--migrate")
+		args, warmth := takeFlag(args, "--warmth")
+		args, turnBased := takeFlag(args, "--turn-based")
+		args, limit, err := parseAttemptLimit(args)
+		if err != nil {
+			return nil, err
+		}
+		var timeout time.Duration
+		if rest, value, found := takeFlagValue(args, "--timeout"); found {
+			args = rest
+			if timeout, err = parseTimeout(value); err != nil {
+				return nil, err
+			}
+		}
+		var idleTimeout time.Duration
+		if rest, value, found := takeFlagValue(args, "--idle-timeout"); found {
+			args = rest
+			if idleTimeout, err = time.ParseDuration(value); err != nil || idleTimeout < 0 {
+				return nil, fmt.Errorf("invalid idle timeout %q", value)
+			}
+		}
+		var pingEvery time.Duration
+		if rest, value, found := takeFlagValue(args, "--ping-interval"); found {
+			args = rest
+			if pingEvery, err = time.ParseDuration(value); err != nil || pingEvery <= 0 {
+				return nil, fmt.Errorf("invalid ping interval %q", value)
+			}
+		}
+		var metricsAddr string
+		if rest, value, found := takeFlagValue(args, "--metrics"); found {
+			args = rest
+			if value == "" {
+				return nil, errors.New("--metrics needs an address")
+			}
+			metricsAddr = value
+		}
+		var httpAddr string
+		if rest, value, found := takeFlagValue(args, "--http"); found {
+			args = rest
+			if value == "" {
+				return nil, errors.New("--http needs an address")
+			}
+			httpAddr = value
+		}
+		historySize := 20
+		if rest, value, found := takeFlagValue(args, "--history-size"); found {
+			args = rest
+			parsed, errH := strconv.Atoi(value)
+			if errH != nil || parsed < 0 {
+				return nil, fmt.Errorf("invalid history size %q", value)
+			}
+			historySize = parsed
+		}
+		var guessRate server.RateLimit
+		if rest, value, found := takeFlagValue(args, "--rate"); found {
+			args = rest
+			var errR error
+			if guessRate, errR = server.ParseRateLimit(value); errR != nil {
+				return nil, errR
+			}
+		}
+		var logFile string
+		logMaxMB, logRotations := 10, 3
+		if rest, value, found := takeFlagValue(args, "--logfile"); found {
+			args = rest
+			if value == "" {
+				return nil, errors.New("--logfile needs a path")
+			}
+			logFile = value
+		}
+		if rest, value, found := takeFlagValue(args, "--logmax-mb"); found {
+			args = rest
+			parsed, errL := strconv.Atoi(value)
+			if errL != nil || parsed < 1 {
+				return nil, fmt.Errorf("invalid log size %q", value)
+			}
+			logMaxMB = parsed
+		}
+		var motd string
+		if rest, value, found := takeFlagValue(args, "--motd"); found {
+			args = rest
+			motd = value
+		}
+		var scoreFile string
+		if rest, value, found := takeFlagValue(args, "--scores"); found {
+			args = rest
+			if value == "" {
+				return nil, errors.New("--scores needs a file path")
+			}
+			scoreFile = value
+		}
+		var password string
+		if rest, value, found := takeFlagValue(args, "--password"); found {
+			args = rest
+			password = value
+		}
+		var rng *rand.Rand
+		if rest, value, found := takeFlagValue(args, "--seed"); found {
+			args = rest
+			seed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid seed %q", value)
+			}
+			rng = rand.New(rand.NewSource(seed))
+		}
+		var generatorSpec string
+		if rest, value, found := takeFlagValue(args, "--generator"); found {
+			args = rest
+			generatorSpec = value
+		}
+		var maxSpectators uint
+		if rest, value, found := takeFlagValue(args, "--spectators"); found {
+			args = rest
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid spectator cap %q", value)
+			}
+			maxSpectators = uint(parsed)
+		}
+		if len(args) < 2 {
+			return nil, errors.New("usage: serve <host> [count] [range] [--limit N] [--turn-based]")
+		}
+		host, err := protocol.NormalizeHostPort(args[1])
+		if err != nil {
+			return nil, err
+		}
+		playerCount := uint(2)
+		if len(args) >= 3 {
+			count, err := strconv.ParseUint(args[2], 10, 32)
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("invalid player count %q", args[2])
+			}
+			playerCount = uint(count)
+		}
+		max := game.DefaultMaxNumber
+		if len(args) >= 4 {
+			var err error
+			if max, err = parseRange(args[3]); err != nil {
+				return nil, err
+			}
+		}
+		var generator game.NumberGenerator
+		if generatorSpec != "" {
+			if generator, err = game.ParseGenerator(generatorSpec, max); err != nil {
+				return nil, err
+			}
+		}
+		opts := server.ServeOptions{
+			MaxNumber:       max,
+			AttemptLimit:    limit,
+			TurnBased:       turnBased,
+			Timeout:         timeout,
+			IdleTimeout:     idleTimeout,
+			PingInterval:    pingEvery,
+			MaxSpectators:   maxSpectators,
+			ScoreFile:       scoreFile,
+			Warmth:          warmth,
+			HardMode:        hard,
+			BestOf:          bestOf,
+			Migrate:         migrate,
+			Generator:       generator,
+			MetricsAddr:     metricsAddr,
+			RoundTimeout:    roundTimeout,
+			GuessTimeout:    guessTimeout,
+			GuessRate:       guessRate,
+			HistorySize:     historySize,
+			HostOnlyReveal:  hostOnlyReveal,
+			MOTD:            motd,
+			LogFile:         logFile,
+			LogMaxSizeMB:    logMaxMB,
+			LogMaxRotations: logRotations,
+			Rng:             rng,
+			HTTPAddr:        httpAddr,
+			Password:        password,
+		}
+		// The TLS branch must carry the exact same options; only the
+		// transport differs.
+		if tlsCert != "" {
+			return CommandServeTLS{
+				Host:        host,
+				PlayerCount: playerCount,
+				Opts:        opts,
+				CertFile:    tlsCert,
+				KeyFile:     tlsKey,
+			}, nil
+		}
+		return CommandServe{
+			Host:        host,
+			PlayerCount: playerCount,
+			Opts:        opts,
+		}, nil
+	case "serve-unix":
+		if len(args) < 2 {
+			return nil, errors.New("usage: serve-unix <path> [count]")
+		}
+		count := uint(2)
+		if len(args) >= 3 {
+			parsed, err := strconv.ParseUint(args[2], 10, 32)
+			if err != nil || parsed < 1 {
+				return nil, fmt.Errorf("invalid player count %q", args[2])
+			}
+			count = uint(parsed)
+		}
+		return CommandServeUnix{Path: args[1], PlayerCount: count}, nil
+	case "connect-unix":
+		if len(args) < 2 {
+			return nil, errors.New("usage: connect-unix <path> [name]")
+		}
+		name := fmt.Sprintf("player%d", rand.Intn(10000))
+		if len(args) >= 3 {
+			name = args[2]
+		}
+		return CommandConnectUnix{Path: args[1], Name: name}, nil
+	case "serve-tls":
+		args, turnBased := takeFlag(args, "--turn-based")
+		args, limit, err := parseAttemptLimit(args)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) < 5 {
+			return nil, errors.New("usage: serve-tls <host> <count> <cert> <key> [--limit N]")
+		}
+		count, err := strconv.ParseUint(args[2], 10, 32)
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("invalid player count %q", args[2])
+		}
+		return CommandServeTLS{
+			Host:        args[1],
+			PlayerCount: uint(count),
+			Opts:        server.ServeOptions{MaxNumber: game.DefaultMaxNumber, AttemptLimit: limit, TurnBased: turnBased},
+			CertFile:    args[3],
+			KeyFile:     args[4],
+		}, nil
+	case "connect":
+		args, useTLS := takeFlag(args, "--tls")
+		args, insecureTLS := takeFlag(args, "--insecure")
+		var caFile string
+		if rest, value, found := takeFlagValue(args, "--ca"); found {
+			args = rest
+			caFile = value
+		}
+		args, spectate := takeFlag(args, "--spectate")
+		var roomName string
+		if rest, value, found := takeFlagValue(args, "--room"); found {
+			args = rest
+			roomName = value
+		}
+		var password string
+		if rest, value, found := takeFlagValue(args, "--password"); found {
+			args = rest
+			password = value
+		}
+		retries := 0
+		if rest, value, found := takeFlagValue(args, "--retry"); found {
+			args = rest
+			var err error
+			if retries, err = strconv.Atoi(value); err != nil || retries < 0 {
+				return nil, fmt.Errorf("invalid retry count %q", value)
+			}
+		}
+		if len(args) < 2 {
+			return nil, errors.New("usage: connect <host> [name] [timeout] [--retry N]")
+		}
+		host := args[1]
+		if !strings.HasPrefix(host, "#") {
+			var err error
+			if host, err = protocol.NormalizeHostPort(host); err != nil {
+				return nil, err
+			}
+		}
+		name := fmt.Sprintf("player%d", rand.Intn(10000))
+		if len(args) >= 3 {
+			name = args[2]
+		}
+		if err := protocol.ValidatePlayerName(name); err != nil {
+			return nil, fmt.Errorf("invalid name: %w", err)
+		}
+		var timeout time.Duration
+		if len(args) >= 4 {
+			var err error
+			if timeout, err = parseTimeout(args[3]); err != nil {
+				return nil, err
+			}
+		}
+		if spectate {
+			return CommandSpectate{Host: host, Name: name, Password: password, Room: roomName}, nil
+		}
+		if useTLS || caFile != "" {
+			return CommandConnectTLS{
+				Host:     host,
+				Name:     name,
+				Insecure: insecureTLS,
+				CAFile:   caFile,
+				Timeout:  timeout,
+				Retries:  retries,
+				Password: password,
+				Room:     roomName,
+			}, nil
+		}
+		return CommandConnect{Host: host, Name: name, Timeout: timeout, Retries: retries, Password: password, Room: roomName}, nil
+	case "spectate", "connect-watch":
+		var password string
+		if rest, value, found := takeFlagValue(args, "--password"); found {
+			args = rest
+			password = value
+		}
+		var roomName string
+		if rest, value, found := takeFlagValue(args, "--room"); found {
+			args = rest
+			roomName = value
+		}
+		if len(args) < 2 {
+			return nil, fmt.Errorf("usage: %s <host> [name] [--password <pw>] [--room <name>]", args[0])
+		}
+		host := args[1]
+		if !strings.HasPrefix(host, "#") {
+			var err error
+			if host, err = protocol.NormalizeHostPort(host); err != nil {
+				return nil, err
+			}
+		}
+		name := fmt.Sprintf("watcher%d", rand.Intn(10000))
+		if len(args) >= 3 {
+			name = args[2]
+		}
+		return CommandSpectate{Host: host, Name: name, Password: password, Room: roomName}, nil
+	case "connect-tls":
+		args, insecure := takeFlag(args, "--insecure")
+		if len(args) < 2 {
+			return nil, errors.New("usage: connect-tls <host> [name] [--insecure]")
+		}
+		host := args[1]
+		if !strings.HasPrefix(host, "#") {
+			var err error
+			if host, err = protocol.NormalizeHostPort(host); err != nil {
+				return nil, err
+			}
+		}
+		name := fmt.Sprintf("player%d", rand.Intn(10000))
+		if len(args) >= 3 {
+			name = args[2]
+		}
+		return CommandConnectTLS{Host: host, Name: name, Insecure: insecure}, nil
+	case "show":
+		if len(args) >= 2 && args[1] == "stats" {
+			return CommandStats{}, nil
+		}
+		return CommandShow{}, nil
+	case "stats":
+		return CommandStats{}, nil
+	case "score", "scores":
+		return CommandScores{}, nil
+	case "status":
+		return CommandStatus{}, nil
+	case "discover":
+		return CommandDiscover{}, nil
+	case "ping":
+		return CommandPing{}, nil
+	case "kick":
+		if len(args) < 2 {
+			return nil, errors.New("usage: kick <name> [reason]")
+		}
+		return CommandKick{Name: args[1], Reason: strings.Join(args[2:], " ")}, nil
+	case "list", "players":
+		return CommandList{}, nil
+	case "stop":
+		return CommandStop{}, nil
+	case "help":
+		return CommandHelp{}, nil
+	case "quit", "exit":
+		return CommandQuit{}, nil
+	}
+	number, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	return CommandGuess{Number: number}, nil
+}
+
+func main() {
+	// Color by default only when stdout is a terminal.
+	color := false
+	if info, err := os.Stdout.Stat(); err == nil {
+		color = info.Mode()&os.ModeCharDevice != 0
+	}
+	scriptPath := ""
+	flags := os.Args[1:]
+	for i := 0; i < len(flags); i++ {
+		arg := flags[i]
+		switch arg {
+		case "--script":
+			if i+1 >= len(flags) {
+				fmt.Fprintln(os.Stderr, "--script needs a file path")
+				os.Exit(2)
+			}
+			i++
+			scriptPath = flags[i]
+		case "--json-log":
+			protocol.DefaultLogger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+		case "--framed":
+			protocol.EnableFramedProtocol()
+		case "--sequenced":
+			protocol.EnableSequencedProtocol()
+		case "--color":
+			color = true
+		case "--no-color":
+			color = false
+		default:
+			fmt.Fprintf(os.Stderr, "unknown flag %q (supported: --json-log, --framed, --sequenced, --color, --no-color, --script <file>)\n", arg)
+			os.Exit(2)
+		}
+	}
+
+	game.SetColorEnabled(color)
+
+	commandChan := make(chan Command)
+
+	// In script mode stdin is unused; the script feeds commands directly.
+	if scriptPath == "" {
+		go readCommands(chooseLineReader(), commandChan)
+	}
+
+	fmt.Println("number guessing game, try help")
+
+	var connection game.Connection
+	var events <-chan game.GameEvent
+	jsonOutput := false
+	var discovered []protocol.ServerInfo
+	var recordFile *os.File
+	defer func() {
+		if recordFile != nil {
+			recordFile.Close()
+		}
+	}()
+	printEvent := func(event game.GameEvent) {
+		if jsonOutput {
+			if line, err := game.MarshalGameEvent(time.Now(), event); err == nil {
+				fmt.Println(string(line))
+			}
+		} else {
+			fmt.Println(game.ColorizeEvent(event, game.GameEventToString(event)))
+		}
+		if recordFile == nil {
+			return
+		}
+		line, err := game.MarshalGameEvent(time.Now(), event)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to record event: %v\n", err)
+			return
+		}
+		if _, err := recordFile.Write(append(line, '\n')); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to record event: %v\n", err)
+		}
+	}
+	setConnection := func(conn game.Connection) {
+		connection = conn
+		if conn != nil {
+			events = conn.Events()
+		} else {
+			events = nil
+		}
+	}
+
+	// handleCommand runs one command synchronously; it reports whether the
+	// REPL should quit. Script mode reuses it without the channel.
+	handleCommand := func(command Command) bool {
+		switch cmd := command.(type) {
+		case CommandLocal:
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			setConnection(game.NewConnectionLocalOpts(cmd.MaxNumber, game.LocalOptions{AttemptLimit: cmd.AttemptLimit, Warmth: cmd.Warmth, HardMode: cmd.Hard, BestOf: cmd.BestOf, RoundTimeout: cmd.RoundTimeout, Rng: cmd.Rng}))
+		case CommandJSON:
+			jsonOutput = !jsonOutput
+			if jsonOutput {
+				game.Printer = jsonSink{}
+				fmt.Println(`{"type":"Mode","json":true}`)
+			} else {
+				game.Printer = humanPrinter{}
+				fmt.Println("human output mode")
+			}
+		case CommandSet:
+			switch conn := connection.(type) {
+			case *server.ConnectionServe:
+				if err := conn.SetNumber(cmd.Number); err != nil {
+					fmt.Println(err)
+				}
+			case *game.ConnectionLocal:
+				if err := conn.SetNumber(cmd.Number); err != nil {
+					fmt.Println(err)
+				}
+			default:
+				fmt.Println("set is only available when serving or playing locally")
+			}
+		case CommandMotd:
+			serve, ok := connection.(*server.ConnectionServe)
+			if !ok {
+				fmt.Println("motd can only be set when serving")
+				return false
+			}
+			serve.SetMOTD(cmd.Text)
+			fmt.Println("motd updated")
+		case CommandRooms:
+			serve, ok := connection.(*server.ConnectionServe)
+			if !ok {
+				fmt.Println("rooms are only visible when serving")
+				return false
+			}
+			serve.Rooms()
+		case CommandRecord:
+			if recordFile != nil {
+				recordFile.Close()
+			}
+			file, err := os.OpenFile(cmd.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "record failed: %v\n", err)
+				recordFile = nil
+				return false
+			}
+			recordFile = file
+			fmt.Printf("recording events to %s\n", cmd.Path)
+		case CommandReplay:
+			if err := runReplay(cmd.Path, cmd.Speed); err != nil {
+				fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+			}
+		case CommandHotseat:
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			setConnection(game.NewConnectionHotseat(cmd.Names, cmd.MaxNumber))
+		case CommandServe:
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			conn, _, err := server.NewConnectionServe(cmd.Host, cmd.PlayerCount, cmd.Opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "serve failed: %v — still no active session\n", err)
+				setConnection(nil)
+				return false
+			}
+			setConnection(conn)
+		case CommandServeUnix:
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			conn, err := server.NewConnectionServeUnix(cmd.Path, cmd.PlayerCount, server.ServeOptions{MaxNumber: game.DefaultMaxNumber})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "serve-unix failed: %v — still no active session\n", err)
+				setConnection(nil)
+				return false
+			}
+			setConnection(conn)
+		case CommandConnectUnix:
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			conn, err := client.NewConnectionRemoteUnix(cmd.Path, cmd.Name)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "connect-unix failed: %v — still no active session\n", err)
+				setConnection(nil)
+				return false
+			}
+			setConnection(conn)
+		case CommandServeTLS:
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			conn, err := server.NewConnectionServeTLS(cmd.Host, cmd.PlayerCount, cmd.Opts, cmd.CertFile, cmd.KeyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "serve-tls failed: %v — still no active session\n", err)
+				setConnection(nil)
+				return false
+			}
+			setConnection(conn)
+		case CommandConnect:
+			host, ok := resolveDiscovered(cmd.Host, discovered)
+			if !ok {
+				return false
+			}
+			cmd.Host = host
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			var conn game.Connection
+			var err error
+			if cmd.Retries > 0 && cmd.Timeout == 0 && cmd.Password == "" && cmd.Room == "" {
+				conn, err = client.DialWithRetry(cmd.Host, cmd.Name, cmd.Retries, time.Second)
+			} else {
+				conn, err = client.NewConnectionRemoteRoom(cmd.Host, cmd.Name, cmd.Timeout, cmd.Retries, protocol.RolePlayer, cmd.Password, cmd.Room)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "connect failed: %v — still no active session\n", err)
+				setConnection(nil)
+				return false
+			}
+			setConnection(conn)
+		case CommandSpectate:
+			host, ok := resolveDiscovered(cmd.Host, discovered)
+			if !ok {
+				return false
+			}
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			conn, err := client.NewConnectionSpectator(host, cmd.Name, cmd.Password, cmd.Room)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "spectate failed: %v — still no active session\n", err)
+				setConnection(nil)
+				return false
+			}
+			setConnection(conn)
+		case CommandConnectTLS:
+			host, ok := resolveDiscovered(cmd.Host, discovered)
+			if !ok {
+				return false
+			}
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			conn, err := client.NewConnectionRemoteTLSCA(host, cmd.Name, "", cmd.CAFile, cmd.Insecure, client.TLSJoinOptions{
+				Timeout:  cmd.Timeout,
+				Retries:  cmd.Retries,
+				Password: cmd.Password,
+				Room:     cmd.Room,
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "connect-tls failed: %v — still no active session\n", err)
+				setConnection(nil)
+				return false
+			}
+			setConnection(conn)
+		case CommandGuess:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			if _, err := connection.Guess(context.Background(), cmd.Number); err != nil {
+				fmt.Println(err)
+			}
+		case CommandShow:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			if _, err := connection.Show(context.Background()); err != nil {
+				fmt.Println(err)
+			}
+		case CommandScores:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			connection.Scores()
+		case CommandStatus:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			connection.Status()
+		case CommandList:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			connection.List()
+		case CommandDiscover:
+			infos, err := protocol.Discover()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "discover failed: %v\n", err)
+				return false
+			}
+			if len(infos) == 0 {
+				fmt.Println("no servers found")
+				return false
+			}
+			discovered = infos
+			for i, info := range infos {
+				fmt.Printf("#%d %s (%d/%d players, protocol v%d)\n", i+1, info.Addr, info.CurrentPlayers, info.PlayerCount, info.Version[3])
+			}
+		case CommandSay:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			connection.Say(cmd.Message)
+		case CommandPing:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			connection.Ping()
+		case CommandKick:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			if err := connection.Kick(cmd.Name, cmd.Reason); err != nil {
+				fmt.Println(err)
+			}
+		case CommandHint:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			connection.Hint()
+		case CommandRestart:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			if err := connection.Restart(); err != nil {
+				fmt.Println(err)
+			}
+		case CommandStats:
+			if connection == nil || connection.RemoteStopped() {
+				fmt.Println("no game session running")
+				return false
+			}
+			if stats := connection.Stats(); !stats.StartedAt.IsZero() {
+				fmt.Print(game.FormatStats(stats))
+			}
+		case CommandStop:
+			if connection == nil {
+				fmt.Println("no game session running")
+				return false
+			}
+			if err := connection.Stop(); err != nil {
+				fmt.Println(err)
+			}
+			setConnection(nil)
+		case CommandHelp:
+			printHelp()
+		case CommandQuit:
+			if connection != nil {
+				_ = connection.Stop()
+			}
+			drainEvents(events, printEvent)
+			return true
+		}
+		return false
+	}
+
+	if scriptPath != "" {
+		runScript(scriptPath, handleCommand, func() { drainEvents(events, printEvent) })
+		return
+	}
+
+	for {
+		// Flush pending events first so feedback is printed before the
+		// next command is processed.
+		select {
+		case event := <-events:
+			printEvent(event)
+			continue
+		default:
+		}
+		select {
+		case event := <-events:
+			printEvent(event)
+		case command := <-commandChan:
+			if handleCommand(command) {
+				return
+			}
+		}
+	}
+}
+
+// resolveDiscovered turns a "#N" host into the address of the matching
+// discover result; other hosts pass through untouched.
+func resolveDiscovered(host string, discovered []protocol.ServerInfo) (string, bool) {
+	if !strings.HasPrefix(host, "#") {
+		return host, true
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(host, "#"))
+	if err != nil || index < 1 || index > len(discovered) {
+		fmt.Printf("no discovered server %s (run discover first)\n", host)
+		return "", false
+	}
+	return discovered[index-1].Addr, true
+}
+
+// runScript feeds a file of commands through the handler one at a time,
+// flushing events between commands so output order is deterministic.
+func runScript(path string, handle func(Command) bool, flush func()) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open script: %v\n", err)
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		command, err := parseCommand(line)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		flush()
+		if handle(command) {
+			return
+		}
+		// Give asynchronous sessions a moment so their feedback lands
+		// before the next scripted command.
+		time.Sleep(50 * time.Millisecond)
+		flush()
+	}
+	handle(CommandQuit{})
+}
+
+// jsonSink re-encodes library output lines as JSON envelopes for machine
+// consumption; humanPrinter restores the default behavior.
+type jsonSink struct{}
+
+func (jsonSink) Println(msg string) {
+	line, _ := json.Marshal(map[string]string{"type": "Message", "text": msg})
+	fmt.Println(string(line))
+}
+
+type humanPrinter struct{}
+
+func (humanPrinter) Println(msg string) {
+	fmt.Println(msg)
+}
+
+// readCommands feeds parsed commands from the reader into the channel
+// until the input ends, always finishing with CommandQuit. A final line
+// without a trailing newline (ReadLine returning data alongside io.EOF)
+// is still parsed and delivered before the quit.
+func readCommands(reader lineReader, commandChan chan<- Command) {
+	ended := false
+	for !ended {
+		input, err := reader.ReadLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				ended = true
+			} else {
+				fmt.Fprintf(os.Stderr, "failed to read input: %v\n", err)
+				break
+			}
+		}
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+		command, err := parseCommand(input)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		commandChan <- command
+	}
+	commandChan <- CommandQuit{}
+}
+
+// lineReader abstracts the REPL input so a richer editor can replace the
+// plain reader when stdin is a terminal.
+type lineReader interface {
+	ReadLine() (string, error)
+}
+
+type plainLineReader struct {
+	r *bufio.Reader
+}
+
+func newPlainLineReader() lineReader {
+	return &plainLineReader{r: bufio.NewReader(os.Stdin)}
+}
+
+func (p *plainLineReader) ReadLine() (string, error) {
+	return p.r.ReadString('\n')
+}
+
+// chooseLineReader picks the history-capable editor on a terminal and the
+// plain reader for piped input.
+func chooseLineReader() lineReader {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return newLineEditor()
+	}
+	return newPlainLineReader()
+}
+
+// drainEvents prints whatever events are already queued before exiting.
+func drainEvents(events <-chan game.GameEvent, printEvent func(game.GameEvent)) {
+	for {
+		select {
+		case event := <-events:
+			printEvent(event)
+		default:
+			return
+		}
+	}
+}
+
+// runReplay prints a recorded session, pacing the output by the recorded
+// timestamps divided by speed.
+func runReplay(path string, speed float64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var prev time.Time
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		ts, event, err := game.UnmarshalGameEvent([]byte(line))
+		if err != nil {
+			return err
+		}
+		if !prev.IsZero() && ts.After(prev) {
+			time.Sleep(time.Duration(float64(ts.Sub(prev)) / speed))
+		}
+		prev = ts
+		fmt.Println(game.GameEventToString(event))
+	}
+	return scanner.Err()
+}
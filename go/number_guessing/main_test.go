@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadCommandsProcessesFinalLineWithoutNewline(t *testing.T) {
+	reader := &plainLineReader{r: bufio.NewReader(strings.NewReader("local 10\n5\nquit"))}
+	commandChan := make(chan Command, 8)
+	readCommands(reader, commandChan)
+	close(commandChan)
+
+	var got []Command
+	for command := range commandChan {
+		got = append(got, command)
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected 4 commands (local, guess, quit, auto-quit), got %d: %#v", len(got), got)
+	}
+	if _, ok := got[0].(CommandLocal); !ok {
+		t.Fatalf("expected CommandLocal first, got %T", got[0])
+	}
+	if guess, ok := got[1].(CommandGuess); !ok || guess.Number != 5 {
+		t.Fatalf("expected guess 5, got %#v", got[1])
+	}
+	if _, ok := got[2].(CommandQuit); !ok {
+		t.Fatalf("the trailing quit without a newline was dropped; got %T", got[2])
+	}
+}
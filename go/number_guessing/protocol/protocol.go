@@ -0,0 +1,1236 @@
+package protocol
+
+import (
+	"number_guessing/game"
+
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// region protocol
+
+var Magic = []byte{0x6e, 0x75, 0x6d, 0x67}
+
+// ProtocolVersion 2 added the structured result/status/scoreboard packets
+// and version 3 replaced pre-rendered event strings with PacketEvent;
+// version 1 peers only understand the join/msg/guess/show/disconnect set.
+var ProtocolVersion = []byte{0, 0, 0, 3}
+
+// SupportedVersions lists every protocol version this build genuinely
+// speaks, newest first; the handshake negotiates the highest common
+// entry. Versions 1 and 2 are deliberately absent: the server talks the
+// v3 packet set (auth challenge, tokens, structured events, history)
+// unconditionally after the handshake, so advertising the old versions
+// would let an actual v1/v2 peer "negotiate" and then desync. A future
+// build that truly encodes per-version can widen this list again.
+var SupportedVersions = [][]byte{{0, 0, 0, 3}}
+
+// maxHandshakeVersions bounds the version list a peer may advertise.
+const maxHandshakeVersions = 16
+
+// DiscoveryPort is the well-known UDP port servers answer probes on.
+const DiscoveryPort = 19876
+
+// DiscoveryMagic opens every discovery probe and reply.
+var DiscoveryMagic = []byte{0xd1, 0x5c, 0x0f, 0xee}
+
+// ServerInfo describes a discovered server.
+type ServerInfo struct {
+	Addr           string
+	PlayerCount    uint
+	CurrentPlayers uint
+	// Version is the protocol version the server advertises; a stream-mode
+	// build (framed/sequenced) is only joinable by a matching build.
+	Version [4]byte
+}
+
+// MarshalServerInfo encodes a discovery reply datagram.
+func MarshalServerInfo(info ServerInfo) []byte {
+	buf := append([]byte{}, DiscoveryMagic...)
+	buf = append(buf, EncodeString(info.Addr)...)
+	buf = binary.AppendUvarint(buf, uint64(info.PlayerCount))
+	buf = binary.AppendUvarint(buf, uint64(info.CurrentPlayers))
+	buf = append(buf, info.Version[:]...)
+	return buf
+}
+
+// ParseServerInfo decodes a discovery reply, combining an unspecified
+// listen host with the sender's address.
+func ParseServerInfo(data []byte, from net.Addr) (ServerInfo, bool) {
+	if !bytes.HasPrefix(data, DiscoveryMagic) {
+		return ServerInfo{}, false
+	}
+	reader := bufio.NewReader(bytes.NewReader(data[len(DiscoveryMagic):]))
+	addr, err := ReadString(reader, MaxStringLen)
+	if err != nil {
+		return ServerInfo{}, false
+	}
+	playerCount, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return ServerInfo{}, false
+	}
+	current, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return ServerInfo{}, false
+	}
+	var version [4]byte
+	if _, err := io.ReadFull(reader, version[:]); err != nil {
+		return ServerInfo{}, false
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		ip := net.ParseIP(host)
+		if host == "" || (ip != nil && ip.IsUnspecified()) {
+			if fromHost, _, err := net.SplitHostPort(from.String()); err == nil {
+				addr = net.JoinHostPort(fromHost, port)
+			}
+		}
+	}
+	return ServerInfo{Addr: addr, PlayerCount: uint(playerCount), CurrentPlayers: uint(current), Version: version}, true
+}
+
+// NormalizeHostPort validates a serve/connect host argument, accepting a
+// bare port ("8080") as shorthand for ":8080" and bracketed IPv6 literals
+// like "[::1]:8080", and returns an address net.Listen/net.Dial accept.
+func NormalizeHostPort(arg string) (string, error) {
+	if arg == "" {
+		return "", errors.New("empty host: use host:port, [v6]:port, or a bare port")
+	}
+	if !strings.Contains(arg, ":") {
+		if _, err := strconv.ParseUint(arg, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid host %q: use host:port, [v6]:port, or a bare port", arg)
+		}
+		return ":" + arg, nil
+	}
+	if _, _, err := net.SplitHostPort(arg); err != nil {
+		return "", fmt.Errorf("invalid host %q (%v): use host:port, [v6]:port, or a bare port", arg, err)
+	}
+	return arg, nil
+}
+
+// Discover broadcasts a probe on the LAN (and loopback) and collects
+// server replies for two seconds.
+func Discover() ([]ServerInfo, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	targets := []*net.UDPAddr{
+		{IP: net.IPv4bcast, Port: DiscoveryPort},
+		{IP: net.IPv4(127, 0, 0, 1), Port: DiscoveryPort},
+	}
+	for _, target := range targets {
+		_, _ = conn.WriteTo(DiscoveryMagic, target)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var infos []ServerInfo
+	seen := make(map[string]bool)
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return infos, nil
+		}
+		if info, ok := ParseServerInfo(buf[:n], from); ok && !seen[info.Addr] {
+			seen[info.Addr] = true
+			infos = append(infos, info)
+		}
+	}
+}
+
+type DisconnectReason uint8
+
+const (
+	Normal DisconnectReason = iota
+	VersionMismatch
+	GameFull
+	IdleTimeout
+	PingTimeout
+	StringTooLong
+	InvalidName
+	TokenExpired
+	TooSlow
+	WrongPassword
+	Kicked
+	// ProtocolError is sent before closing a connection that delivered a
+	// syntactically valid but unexpected packet.
+	ProtocolError
+	SpectatorsFull
+)
+
+func (r DisconnectReason) Error() string {
+	switch r {
+	case Normal:
+		return "disconnected"
+	case VersionMismatch:
+		return "protocol version mismatch"
+	case GameFull:
+		return "game is full"
+	case IdleTimeout:
+		return "kicked for inactivity"
+	case PingTimeout:
+		return "no answer to keepalive ping"
+	case StringTooLong:
+		return "sent an overlong string"
+	case InvalidName:
+		return "invalid player name"
+	case TokenExpired:
+		return "reconnect token expired"
+	case TooSlow:
+		return "fell too far behind on events"
+	case WrongPassword:
+		return "wrong password"
+	case Kicked:
+		return "kicked by the host"
+	case ProtocolError:
+		return "protocol error"
+	case SpectatorsFull:
+		return "no spectator slots left"
+	}
+	return fmt.Sprintf("unknown disconnect reason (%d)", uint8(r))
+}
+
+type PacketId uint8
+
+const (
+	PacketIdJoinAs PacketId = iota
+	PacketIdMsg
+	PacketIdGuess
+	PacketIdShow
+	PacketIdDisconnect
+	PacketIdScoreboard
+	PacketIdScoreRequest
+	PacketIdGuessResult
+	PacketIdStatus
+	PacketIdStatusResp
+	PacketIdPlayerListRequest
+	PacketIdPlayerList
+	PacketIdEvent
+	PacketIdIdleWarning
+	PacketIdPing
+	PacketIdPong
+	PacketIdStatsRequest
+	PacketIdStats
+	PacketIdChat
+	PacketIdToken
+	PacketIdAuthChallenge
+	PacketIdPassword
+	PacketIdRestart
+	PacketIdHistory
+)
+
+// GameEventId identifies a game event type inside PacketEvent.
+type GameEventId uint8
+
+const (
+	GameEventIdPlayerJoin GameEventId = iota
+	GameEventIdPlayerQuit
+	GameEventIdGameNew
+	GameEventIdGameStop
+	GameEventIdGameGuess
+	GameEventIdGameShow
+	GameEventIdGameLost
+	GameEventIdTurnChange
+	GameEventIdRoundEnd
+	GameEventIdChat
+	GameEventIdMessage
+	GameEventIdMatchOver
+	GameEventIdGameTimeout
+	GameEventIdSpectatorJoin
+	GameEventIdSpectatorLeave
+)
+
+type Packet interface{}
+
+// PlayerRole says whether a joiner plays or only watches.
+type PlayerRole uint8
+
+const (
+	RolePlayer PlayerRole = iota
+	RoleSpectator
+)
+
+type PacketJoinAs struct {
+	Name string
+	// Max is the exclusive upper bound of the guessing range, filled in by
+	// the server in its join response so clients can display valid bounds.
+	Max int64
+	// Role requests joining as a player or a spectator.
+	Role PlayerRole
+	// Token resumes a recently dropped session when it matches the one the
+	// server issued; all zero means a fresh join.
+	Token [16]byte
+	// Room names the game to join on a multi-room server; empty selects
+	// the default room.
+	Room string
+}
+
+// PacketAuthChallenge is sent by the server right after the version
+// exchange; Required tells the client whether a PacketPassword must come
+// before the join.
+type PacketAuthChallenge struct {
+	Required bool
+}
+
+type PacketPassword struct {
+	Password string
+}
+
+// PacketRestart asks the server to pick a new number without revealing
+// the old one.
+type PacketRestart struct{}
+
+// PacketHistory replays recent game events (already rendered) to a
+// freshly joined client.
+type PacketHistory struct {
+	Events []string
+}
+
+// PacketToken hands a client the secret it can use to resume its slot
+// after an unexpected disconnect.
+type PacketToken struct {
+	Token [16]byte
+}
+
+type PacketMsg struct {
+	Msg string
+}
+
+type PacketGuess struct {
+	Number int64
+}
+
+type PacketShow struct{}
+
+type PacketDisconnect struct {
+	Reason DisconnectReason
+}
+
+type PacketScoreboard struct {
+	Scores map[string]int
+}
+
+type PacketScoreRequest struct{}
+
+type PacketStatus struct{}
+
+type PacketStatusResp struct {
+	CurrentPlayers uint
+	TargetPlayers  uint
+	Playable       bool
+}
+
+// PacketEvent carries a structured game event so clients can react
+// programmatically instead of parsing rendered strings.
+type PacketEvent struct {
+	Event game.GameEvent
+}
+
+// PacketIdleWarning tells a player they are about to be kicked for
+// inactivity.
+type PacketIdleWarning struct{}
+
+// PacketPing probes whether the peer is still alive; the nonce comes back
+// in the matching PacketPong.
+type PacketPing struct {
+	Nonce uint64
+}
+
+type PacketPong struct {
+	Nonce uint64
+}
+
+// PacketChat carries a chat message from a client; the server rebroadcasts
+// it as a game.GameEventChat with the sender's name attached.
+type PacketChat struct {
+	Message string
+}
+
+type PacketStatsRequest struct{}
+
+type PacketStats struct {
+	Stats game.SessionStats
+}
+
+type PacketPlayerListRequest struct{}
+
+type PacketPlayerList struct {
+	Names []string
+	// Target is how many players the game needs before it starts.
+	Target uint
+	// Spectators lists who is watching without playing.
+	Spectators []string
+}
+
+// PacketGuessResult is the server's machine-readable answer to a
+// PacketGuess, echoing the guessed number. Lo and Hi are the remaining
+// valid half-open range after this guess, letting clients track bounds.
+type PacketGuessResult struct {
+	Result game.GuessResult
+	Number int64
+	Lo     int64
+	Hi     int64
+}
+
+func EncodeString(str string) []byte {
+	buf := make([]byte, 0, len(str)+binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, uint64(len(str)))
+	return append(buf, str...)
+}
+
+// MaxNameLen bounds player names on the wire; MaxStringLen bounds every
+// other string (messages, reasons). Both protect the reader from a peer
+// advertising a huge length and forcing a giant allocation.
+const MaxNameLen = 64
+const MaxStringLen = 4096
+
+// MaxChatLen keeps chat lines short enough to not flood terminals.
+const MaxChatLen = 256
+
+// ErrStringTooLong reports a peer-supplied string above the caller's cap.
+var ErrStringTooLong = errors.New("string too long")
+
+func ReadString(reader *bufio.Reader, maxLen uint64) (string, error) {
+	strLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	if strLen > maxLen {
+		return "", fmt.Errorf("%w: %d bytes (limit %d)", ErrStringTooLong, strLen, maxLen)
+	}
+	buf := make([]byte, strLen)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return "", err
+	}
+	if !utf8.Valid(buf) {
+		return "", errors.New("invalid utf8 string")
+	}
+	return string(buf), nil
+}
+
+// maxNameRunes caps a player name's visible length.
+const maxNameRunes = 32
+
+// ValidatePlayerName rejects names that would corrupt terminal output or
+// make events ambiguous: empty after trimming, longer than 32 runes,
+// containing control characters, or containing invisible format runes
+// (zero-width spaces and friends) that let two players spoof the same
+// visible name. The server applies it at join and the CLI before
+// connecting.
+func ValidatePlayerName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name is empty")
+	}
+	if len([]rune(name)) > maxNameRunes {
+		return fmt.Errorf("name is longer than %d characters", maxNameRunes)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return errors.New("name contains control characters")
+		}
+		if unicode.In(r, unicode.Cf) {
+			return errors.New("name contains invisible characters")
+		}
+	}
+	return nil
+}
+
+func SendPacket(w io.Writer, packet Packet) error {
+	buf := make([]byte, 0, 16)
+	switch p := packet.(type) {
+	case PacketJoinAs:
+		buf = append(buf, byte(PacketIdJoinAs))
+		buf = append(buf, EncodeString(p.Name)...)
+		buf = binary.AppendVarint(buf, p.Max)
+		buf = append(buf, byte(p.Role))
+		buf = append(buf, p.Token[:]...)
+		buf = append(buf, EncodeString(p.Room)...)
+	case PacketToken:
+		buf = append(buf, byte(PacketIdToken))
+		buf = append(buf, p.Token[:]...)
+	case PacketAuthChallenge:
+		required := byte(0)
+		if p.Required {
+			required = 1
+		}
+		buf = append(buf, byte(PacketIdAuthChallenge), required)
+	case PacketPassword:
+		buf = append(buf, byte(PacketIdPassword))
+		buf = append(buf, EncodeString(p.Password)...)
+	case PacketRestart:
+		buf = append(buf, byte(PacketIdRestart))
+	case PacketHistory:
+		buf = append(buf, byte(PacketIdHistory))
+		buf = binary.AppendUvarint(buf, uint64(len(p.Events)))
+		for _, line := range p.Events {
+			buf = append(buf, EncodeString(line)...)
+		}
+	case PacketMsg:
+		buf = append(buf, byte(PacketIdMsg))
+		buf = append(buf, EncodeString(p.Msg)...)
+	case PacketGuess:
+		buf = append(buf, byte(PacketIdGuess))
+		buf = binary.AppendVarint(buf, p.Number)
+	case PacketShow:
+		buf = append(buf, byte(PacketIdShow))
+	case PacketDisconnect:
+		buf = append(buf, byte(PacketIdDisconnect), byte(p.Reason))
+	case PacketScoreRequest:
+		buf = append(buf, byte(PacketIdScoreRequest))
+	case PacketGuessResult:
+		buf = append(buf, byte(PacketIdGuessResult), byte(p.Result))
+		buf = binary.AppendVarint(buf, p.Number)
+		buf = binary.AppendVarint(buf, p.Lo)
+		buf = binary.AppendVarint(buf, p.Hi)
+	case PacketStatus:
+		buf = append(buf, byte(PacketIdStatus))
+	case PacketPlayerListRequest:
+		buf = append(buf, byte(PacketIdPlayerListRequest))
+	case PacketIdleWarning:
+		buf = append(buf, byte(PacketIdIdleWarning))
+	case PacketPing:
+		buf = append(buf, byte(PacketIdPing))
+		buf = binary.AppendUvarint(buf, p.Nonce)
+	case PacketPong:
+		buf = append(buf, byte(PacketIdPong))
+		buf = binary.AppendUvarint(buf, p.Nonce)
+	case PacketChat:
+		buf = append(buf, byte(PacketIdChat))
+		buf = append(buf, EncodeString(p.Message)...)
+	case PacketStatsRequest:
+		buf = append(buf, byte(PacketIdStatsRequest))
+	case PacketStats:
+		buf = append(buf, byte(PacketIdStats))
+		buf = binary.AppendVarint(buf, int64(p.Stats.Rounds))
+		buf = binary.AppendVarint(buf, int64(p.Stats.TotalGuesses))
+		buf = binary.AppendVarint(buf, int64(p.Stats.CorrectGuesses))
+		buf = binary.AppendVarint(buf, p.Stats.StartedAt.Unix())
+	case PacketEvent:
+		buf = append(buf, byte(PacketIdEvent))
+		buf = AppendGameEvent(buf, p.Event)
+	case PacketPlayerList:
+		buf = append(buf, byte(PacketIdPlayerList))
+		buf = binary.AppendUvarint(buf, uint64(len(p.Names)))
+		for _, name := range p.Names {
+			buf = append(buf, EncodeString(name)...)
+		}
+		buf = binary.AppendUvarint(buf, uint64(p.Target))
+		buf = binary.AppendUvarint(buf, uint64(len(p.Spectators)))
+		for _, name := range p.Spectators {
+			buf = append(buf, EncodeString(name)...)
+		}
+	case PacketStatusResp:
+		buf = append(buf, byte(PacketIdStatusResp))
+		buf = binary.AppendUvarint(buf, uint64(p.CurrentPlayers))
+		buf = binary.AppendUvarint(buf, uint64(p.TargetPlayers))
+		playable := byte(0)
+		if p.Playable {
+			playable = 1
+		}
+		buf = append(buf, playable)
+	case PacketScoreboard:
+		buf = append(buf, byte(PacketIdScoreboard))
+		buf = binary.AppendUvarint(buf, uint64(len(p.Scores)))
+		names := make([]string, 0, len(p.Scores))
+		for name := range p.Scores {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			buf = append(buf, EncodeString(name)...)
+			buf = binary.AppendVarint(buf, int64(p.Scores[name]))
+		}
+	default:
+		panic("unknown packet")
+	}
+	if SequencedProtocol {
+		buf = append(binary.BigEndian.AppendUint32(nil, sendSeq.Add(1)), buf...)
+	}
+	if FramedProtocol {
+		frame := binary.BigEndian.AppendUint32(nil, uint32(len(buf)))
+		buf = append(frame, buf...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadPacket reads a packet, discarding the sequence number; connection
+// loops that want to check ordering use ReadSeqPacket.
+func ReadPacket(reader *bufio.Reader) (Packet, error) {
+	seqPacket, err := ReadSeqPacket(reader)
+	return seqPacket.Packet, err
+}
+
+func ReadSeqPacket(reader *bufio.Reader) (SeqPacket, error) {
+	if FramedProtocol {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(reader, lenBuf[:]); err != nil {
+			return SeqPacket{}, err
+		}
+		frameLen := binary.BigEndian.Uint32(lenBuf[:])
+		if frameLen == 0 || frameLen > maxFrameLen {
+			return SeqPacket{}, fmt.Errorf("unreasonable frame length: %d", frameLen)
+		}
+		frame := make([]byte, frameLen)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return SeqPacket{}, err
+		}
+		reader = bufio.NewReader(bytes.NewReader(frame))
+	}
+	var seq uint32
+	if SequencedProtocol {
+		var seqBuf [4]byte
+		if _, err := io.ReadFull(reader, seqBuf[:]); err != nil {
+			return SeqPacket{}, err
+		}
+		seq = binary.BigEndian.Uint32(seqBuf[:])
+	}
+	packet, err := readPacketBody(reader)
+	return SeqPacket{Seq: seq, Packet: packet}, err
+}
+
+func readPacketBody(reader *bufio.Reader) (Packet, error) {
+	id, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch PacketId(id) {
+	case PacketIdJoinAs:
+		name, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		max, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		role, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if PlayerRole(role) > RoleSpectator {
+			return nil, fmt.Errorf("unknown player role: %d", role)
+		}
+		var token [16]byte
+		if _, err := io.ReadFull(reader, token[:]); err != nil {
+			return nil, err
+		}
+		roomName, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		return PacketJoinAs{Name: name, Max: max, Role: PlayerRole(role), Token: token, Room: roomName}, nil
+	case PacketIdToken:
+		var token [16]byte
+		if _, err := io.ReadFull(reader, token[:]); err != nil {
+			return nil, err
+		}
+		return PacketToken{Token: token}, nil
+	case PacketIdAuthChallenge:
+		required, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return PacketAuthChallenge{Required: required != 0}, nil
+	case PacketIdPassword:
+		password, err := ReadString(reader, MaxStringLen)
+		if err != nil {
+			return nil, err
+		}
+		return PacketPassword{Password: password}, nil
+	case PacketIdRestart:
+		return PacketRestart{}, nil
+	case PacketIdHistory:
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		events := make([]string, 0, count)
+		for i := uint64(0); i < count; i++ {
+			line, err := ReadString(reader, MaxStringLen)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, line)
+		}
+		return PacketHistory{Events: events}, nil
+	case PacketIdMsg:
+		msg, err := ReadString(reader, MaxStringLen)
+		if err != nil {
+			return nil, err
+		}
+		return PacketMsg{Msg: msg}, nil
+	case PacketIdGuess:
+		number, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		return PacketGuess{Number: number}, nil
+	case PacketIdShow:
+		return PacketShow{}, nil
+	case PacketIdDisconnect:
+		reason, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return PacketDisconnect{Reason: DisconnectReason(reason)}, nil
+	case PacketIdScoreboard:
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		scores := make(map[string]int, count)
+		for i := uint64(0); i < count; i++ {
+			name, err := ReadString(reader, MaxNameLen)
+			if err != nil {
+				return nil, err
+			}
+			score, err := binary.ReadVarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			scores[name] = int(score)
+		}
+		return PacketScoreboard{Scores: scores}, nil
+	case PacketIdScoreRequest:
+		return PacketScoreRequest{}, nil
+	case PacketIdGuessResult:
+		result, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if game.GuessResult(result) > game.Wrong {
+			return nil, fmt.Errorf("unknown guess result: %d", result)
+		}
+		number, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		lo, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		return PacketGuessResult{Result: game.GuessResult(result), Number: number, Lo: lo, Hi: hi}, nil
+	case PacketIdStatus:
+		return PacketStatus{}, nil
+	case PacketIdPlayerListRequest:
+		return PacketPlayerListRequest{}, nil
+	case PacketIdIdleWarning:
+		return PacketIdleWarning{}, nil
+	case PacketIdPing:
+		nonce, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		return PacketPing{Nonce: nonce}, nil
+	case PacketIdPong:
+		nonce, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		return PacketPong{Nonce: nonce}, nil
+	case PacketIdChat:
+		msg, err := ReadString(reader, MaxChatLen)
+		if err != nil {
+			return nil, err
+		}
+		return PacketChat{Message: msg}, nil
+	case PacketIdStatsRequest:
+		return PacketStatsRequest{}, nil
+	case PacketIdStats:
+		var fields [4]int64
+		for i := range fields {
+			value, err := binary.ReadVarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			fields[i] = value
+		}
+		stats := game.SessionStats{
+			Rounds:         int(fields[0]),
+			TotalGuesses:   int(fields[1]),
+			CorrectGuesses: int(fields[2]),
+			StartedAt:      time.Unix(fields[3], 0),
+		}
+		if stats.Rounds > 0 {
+			stats.AvgGuesses = float64(stats.TotalGuesses) / float64(stats.Rounds)
+		}
+		return PacketStats{Stats: stats}, nil
+	case PacketIdEvent:
+		event, err := ReadGameEvent(reader)
+		if err != nil {
+			return nil, err
+		}
+		return PacketEvent{Event: event}, nil
+	case PacketIdPlayerList:
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, count)
+		for i := uint64(0); i < count; i++ {
+			name, err := ReadString(reader, MaxNameLen)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+		}
+		target, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		watcherCount, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		spectators := make([]string, 0, watcherCount)
+		for i := uint64(0); i < watcherCount; i++ {
+			name, err := ReadString(reader, MaxNameLen)
+			if err != nil {
+				return nil, err
+			}
+			spectators = append(spectators, name)
+		}
+		return PacketPlayerList{Names: names, Target: uint(target), Spectators: spectators}, nil
+	case PacketIdStatusResp:
+		current, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		target, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		playable, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		return PacketStatusResp{
+			CurrentPlayers: uint(current),
+			TargetPlayers:  uint(target),
+			Playable:       playable != 0,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown packet id: %d", id)
+}
+
+func AppendGameEvent(buf []byte, event game.GameEvent) []byte {
+	switch e := event.(type) {
+	case game.GameEventPlayerJoin:
+		buf = append(buf, byte(GameEventIdPlayerJoin))
+		buf = append(buf, EncodeString(e.Name)...)
+		spectator := byte(0)
+		if e.Spectator {
+			spectator = 1
+		}
+		buf = append(buf, spectator)
+	case game.GameEventPlayerQuit:
+		buf = append(buf, byte(GameEventIdPlayerQuit))
+		buf = append(buf, EncodeString(e.Name)...)
+	case game.GameEventGameNew:
+		buf = append(buf, byte(GameEventIdGameNew))
+	case game.GameEventGameStop:
+		buf = append(buf, byte(GameEventIdGameStop))
+		buf = append(buf, EncodeString(e.Reason)...)
+	case game.GameEventGameGuess:
+		buf = append(buf, byte(GameEventIdGameGuess))
+		buf = append(buf, EncodeString(e.Name)...)
+		buf = binary.AppendVarint(buf, e.Number)
+		buf = append(buf, byte(e.Result))
+		buf = binary.AppendVarint(buf, int64(e.Attempts))
+		buf = append(buf, EncodeString(e.Proximity)...)
+	case game.GameEventGameShow:
+		buf = append(buf, byte(GameEventIdGameShow))
+		buf = append(buf, EncodeString(e.Name)...)
+		buf = binary.AppendVarint(buf, e.Number)
+	case game.GameEventGameLost:
+		buf = append(buf, byte(GameEventIdGameLost))
+		buf = append(buf, EncodeString(e.Name)...)
+		buf = binary.AppendVarint(buf, e.Number)
+	case game.GameEventTurnChange:
+		buf = append(buf, byte(GameEventIdTurnChange))
+		buf = append(buf, EncodeString(e.PlayerName)...)
+	case game.GameEventChat:
+		buf = append(buf, byte(GameEventIdChat))
+		buf = append(buf, EncodeString(e.From)...)
+		buf = append(buf, EncodeString(e.Message)...)
+	case game.GameEventMessage:
+		buf = append(buf, byte(GameEventIdMessage))
+		buf = append(buf, EncodeString(e.Text)...)
+	case game.GameEventGameTimeout:
+		buf = append(buf, byte(GameEventIdGameTimeout))
+		buf = binary.AppendVarint(buf, e.Number)
+	case game.GameEventSpectatorJoin:
+		buf = append(buf, byte(GameEventIdSpectatorJoin))
+		buf = append(buf, EncodeString(e.Name)...)
+	case game.GameEventSpectatorLeave:
+		buf = append(buf, byte(GameEventIdSpectatorLeave))
+		buf = append(buf, EncodeString(e.Name)...)
+	case game.GameEventMatchOver:
+		buf = append(buf, byte(GameEventIdMatchOver))
+		buf = append(buf, EncodeString(e.Winner)...)
+		buf = binary.AppendUvarint(buf, uint64(len(e.Wins)))
+		matchNames := make([]string, 0, len(e.Wins))
+		for name := range e.Wins {
+			matchNames = append(matchNames, name)
+		}
+		sort.Strings(matchNames)
+		for _, name := range matchNames {
+			buf = append(buf, EncodeString(name)...)
+			buf = binary.AppendVarint(buf, int64(e.Wins[name]))
+		}
+	case game.GameEventRoundEnd:
+		buf = append(buf, byte(GameEventIdRoundEnd))
+		buf = append(buf, EncodeString(e.Winner)...)
+		buf = binary.AppendVarint(buf, int64(e.Round))
+		buf = binary.AppendUvarint(buf, uint64(len(e.Guesses)))
+		names := make([]string, 0, len(e.Guesses))
+		for name := range e.Guesses {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			buf = append(buf, EncodeString(name)...)
+			buf = binary.AppendVarint(buf, int64(e.Guesses[name]))
+		}
+	default:
+		panic("unknown game event")
+	}
+	return buf
+}
+
+func ReadGameEvent(reader *bufio.Reader) (game.GameEvent, error) {
+	id, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch GameEventId(id) {
+	case GameEventIdPlayerJoin, GameEventIdPlayerQuit, GameEventIdTurnChange:
+		name, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		switch GameEventId(id) {
+		case GameEventIdPlayerJoin:
+			spectator, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			return game.GameEventPlayerJoin{Name: name, Spectator: spectator != 0}, nil
+		case GameEventIdPlayerQuit:
+			return game.GameEventPlayerQuit{Name: name}, nil
+		default:
+			return game.GameEventTurnChange{PlayerName: name}, nil
+		}
+	case GameEventIdGameNew:
+		return game.GameEventGameNew{}, nil
+	case GameEventIdGameStop:
+		reason, err := ReadString(reader, MaxStringLen)
+		if err != nil {
+			return nil, err
+		}
+		return game.GameEventGameStop{Reason: reason}, nil
+	case GameEventIdGameGuess:
+		name, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		number, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		result, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if game.GuessResult(result) > game.Wrong {
+			return nil, fmt.Errorf("unknown guess result: %d", result)
+		}
+		attempts, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		proximity, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		return game.GameEventGameGuess{Name: name, Number: number, Result: game.GuessResult(result), Attempts: int(attempts), Proximity: proximity}, nil
+	case GameEventIdGameShow, GameEventIdGameLost:
+		name, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		number, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if GameEventId(id) == GameEventIdGameShow {
+			return game.GameEventGameShow{Name: name, Number: number}, nil
+		}
+		return game.GameEventGameLost{Name: name, Number: number}, nil
+	case GameEventIdMessage:
+		text, err := ReadString(reader, MaxStringLen)
+		if err != nil {
+			return nil, err
+		}
+		return game.GameEventMessage{Text: text}, nil
+	case GameEventIdChat:
+		from, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		message, err := ReadString(reader, MaxChatLen)
+		if err != nil {
+			return nil, err
+		}
+		return game.GameEventChat{From: from, Message: message}, nil
+	case GameEventIdGameTimeout:
+		number, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		return game.GameEventGameTimeout{Number: number}, nil
+	case GameEventIdSpectatorJoin, GameEventIdSpectatorLeave:
+		name, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		if GameEventId(id) == GameEventIdSpectatorJoin {
+			return game.GameEventSpectatorJoin{Name: name}, nil
+		}
+		return game.GameEventSpectatorLeave{Name: name}, nil
+	case GameEventIdMatchOver:
+		winner, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		wins := make(map[string]int, count)
+		for i := uint64(0); i < count; i++ {
+			name, err := ReadString(reader, MaxNameLen)
+			if err != nil {
+				return nil, err
+			}
+			n, err := binary.ReadVarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			wins[name] = int(n)
+		}
+		return game.GameEventMatchOver{Winner: winner, Wins: wins}, nil
+	case GameEventIdRoundEnd:
+		winner, err := ReadString(reader, MaxNameLen)
+		if err != nil {
+			return nil, err
+		}
+		roundNo, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		count, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		guesses := make(map[string]int, count)
+		for i := uint64(0); i < count; i++ {
+			name, err := ReadString(reader, MaxNameLen)
+			if err != nil {
+				return nil, err
+			}
+			n, err := binary.ReadVarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			guesses[name] = int(n)
+		}
+		return game.GameEventRoundEnd{Winner: winner, Round: int(roundNo), Guesses: guesses}, nil
+	}
+	return nil, fmt.Errorf("unknown game event id: %d", id)
+}
+
+func SendMsg(w io.Writer, msg string) error {
+	return SendPacket(w, PacketMsg{Msg: msg})
+}
+
+func SendMsgFmt(w io.Writer, format string, args ...any) error {
+	return SendMsg(w, fmt.Sprintf(format, args...))
+}
+
+// FramedProtocol, when enabled before any connection is made, prepends a
+// big-endian uint32 byte count to every packet so a complete frame can be
+// read before parsing. Framing changes the stream layout, so both peers
+// must enable it: EnableFramedProtocol switches the advertised protocol
+// version to 4 and drops the unframed versions, which makes a mixed pair
+// fail the handshake with VersionMismatch instead of desyncing mid-game.
+var FramedProtocol bool
+
+// maxFrameLen bounds a framed packet so a bad length prefix cannot force
+// a huge allocation.
+const maxFrameLen = 64 * 1024
+
+// EnableFramedProtocol turns on length-prefixed framing for this process.
+func EnableFramedProtocol() {
+	FramedProtocol = true
+	refreshAdvertisedVersions()
+}
+
+// SequencedProtocol, when enabled before any connection is made, prepends
+// a big-endian uint32 sequence number to every packet so the connection
+// layer can detect reordering bugs. Like framing it changes the stream
+// layout, so both peers must enable it: the advertised protocol version
+// becomes 5 exclusively and mixed pairs fail the handshake cleanly.
+var SequencedProtocol bool
+
+// sendSeq numbers every packet this process writes; per-connection
+// sequences are therefore strictly increasing even though they skip
+// values when several connections interleave.
+var sendSeq atomic.Uint32
+
+// EnableSequencedProtocol turns on packet sequence numbers for this
+// process.
+func EnableSequencedProtocol() {
+	SequencedProtocol = true
+	refreshAdvertisedVersions()
+}
+
+// refreshAdvertisedVersions derives the advertised protocol version from
+// the active stream modes. Each combination has its own version — 4 for
+// framing, 5 for sequencing, 6 for both — so two peers only negotiate
+// successfully when their stream layouts actually match; a peer with a
+// different mode set fails the handshake with VersionMismatch instead of
+// desyncing mid-stream.
+func refreshAdvertisedVersions() {
+	switch {
+	case FramedProtocol && SequencedProtocol:
+		ProtocolVersion = []byte{0, 0, 0, 6}
+	case FramedProtocol:
+		ProtocolVersion = []byte{0, 0, 0, 4}
+	case SequencedProtocol:
+		ProtocolVersion = []byte{0, 0, 0, 5}
+	default:
+		return
+	}
+	SupportedVersions = [][]byte{ProtocolVersion}
+}
+
+// SeqPacket pairs a decoded packet with the sequence number it carried
+// (zero when the sequenced protocol is off).
+type SeqPacket struct {
+	Seq    uint32
+	Packet Packet
+}
+
+// SendMagicAndProtoVer advertises the magic followed by every supported
+// protocol version.
+func SendMagicAndProtoVer(w io.Writer) error {
+	buf := append([]byte{}, Magic...)
+	buf = binary.AppendUvarint(buf, uint64(len(SupportedVersions)))
+	for _, version := range SupportedVersions {
+		buf = append(buf, version...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// CheckMagicAndProtoVer reads the peer's advertisement and returns the
+// highest protocol version both sides support, or VersionMismatch when
+// there is no overlap.
+func CheckMagicAndProtoVer(reader *bufio.Reader) ([]byte, error) {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, Magic) {
+		return nil, errors.New("bad magic")
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 || count > maxHandshakeVersions {
+		return nil, fmt.Errorf("unreasonable version count: %d", count)
+	}
+	var best []byte
+	for i := uint64(0); i < count; i++ {
+		version := make([]byte, len(ProtocolVersion))
+		if _, err := io.ReadFull(reader, version); err != nil {
+			return nil, err
+		}
+		for _, supported := range SupportedVersions {
+			if bytes.Equal(version, supported) && bytes.Compare(version, best) > 0 {
+				best = version
+			}
+		}
+	}
+	if best == nil {
+		return nil, VersionMismatch
+	}
+	return best, nil
+}
+
+// DefaultTimeout is used for the handshake and whenever no explicit
+// timeout is configured.
+const DefaultTimeout = time.Second * 5
+
+// DefaultPingInterval is how long a connection may stay silent before a keepalive
+// ping goes out; PongWait is how long the answer may take.
+const DefaultPingInterval = 30 * time.Second
+const PongWait = 10 * time.Second
+
+// UpdateDeadline arms a read/write deadline; a non-positive timeout
+// disables deadlines entirely.
+func UpdateDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout <= 0 {
+		_ = conn.SetDeadline(time.Time{})
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func UpdateSendDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout <= 0 {
+		_ = conn.SetWriteDeadline(time.Time{})
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+}
+
+// DefaultLogger receives diagnostics from connections that were not given
+// their own logger. Replace it (or swap its handler) to redirect or
+// restructure the output.
+var DefaultLogger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+func FailedToSend(logger *slog.Logger, name string, err error) {
+	logger.Error("failed to send packet", "action", "send", "player", name, "err", err)
+}
+
+func FailedToRecv(logger *slog.Logger, name string, err error) {
+	logger.Error("failed to recv packet", "action", "recv", "player", name, "err", err)
+}
+
+func UnexpectedClose(logger *slog.Logger, name string, err error) {
+	logger.Warn("connection unexpectedly closed", "action", "recv", "player", name, "err", err)
+}
+
+// endregion
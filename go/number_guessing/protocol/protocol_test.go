@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// peerAdvertisement builds the handshake bytes a peer supporting the given
+// versions would send.
+func peerAdvertisement(versions ...[]byte) *bufio.Reader {
+	buf := append([]byte{}, Magic...)
+	buf = append(buf, byte(len(versions)))
+	for _, version := range versions {
+		buf = append(buf, version...)
+	}
+	return bufio.NewReader(bytes.NewReader(buf))
+}
+
+func TestReadStringRejectsOversizedLength(t *testing.T) {
+	// A length prefix far above the cap must fail before any allocation,
+	// even though no string bytes follow.
+	buf := binary.AppendUvarint(nil, 1<<40)
+	_, err := ReadString(bufio.NewReader(bytes.NewReader(buf)), MaxNameLen)
+	if !errors.Is(err, ErrStringTooLong) {
+		t.Fatalf("expected ErrStringTooLong, got %v", err)
+	}
+
+	// At the cap it still works.
+	name := strings.Repeat("a", MaxNameLen)
+	buf = binary.AppendUvarint(nil, uint64(len(name)))
+	buf = append(buf, name...)
+	got, err := ReadString(bufio.NewReader(bytes.NewReader(buf)), MaxNameLen)
+	if err != nil || got != name {
+		t.Fatalf("expected %q, got %q (%v)", name, got, err)
+	}
+}
+
+func TestValidatePlayerName(t *testing.T) {
+	for _, name := range []string{"", "   ", "a\nb", "esc\x1b[31m", "zero\u200bwidth", "\u200b\u200b", strings.Repeat("x", 33)} {
+		if err := ValidatePlayerName(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+	for _, name := range []string{"alice", "бек", "player 2"} {
+		if err := ValidatePlayerName(name); err != nil {
+			t.Errorf("expected %q to be accepted, got %v", name, err)
+		}
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	// A peer that only speaks versions this build no longer advertises is
+	// rejected outright rather than being allowed to desync later.
+	if _, err := CheckMagicAndProtoVer(peerAdvertisement([]byte{0, 0, 0, 1}, []byte{0, 0, 0, 2})); !errors.Is(err, VersionMismatch) {
+		t.Fatalf("expected VersionMismatch for a v1/v2-only peer, got %v", err)
+	}
+
+	// A newer peer advertising versions we don't know yet settles on the
+	// highest common one.
+	got, err := CheckMagicAndProtoVer(peerAdvertisement([]byte{0, 0, 0, 9}, ProtocolVersion, []byte{0, 0, 0, 1}))
+	if err != nil {
+		t.Fatalf("newer peer rejected: %v", err)
+	}
+	if !bytes.Equal(got, ProtocolVersion) {
+		t.Fatalf("expected %v with a newer peer, got %v", ProtocolVersion, got)
+	}
+
+	// No overlap at all is a mismatch.
+	if _, err := CheckMagicAndProtoVer(peerAdvertisement([]byte{0, 0, 0, 9})); !errors.Is(err, VersionMismatch) {
+		t.Fatalf("expected VersionMismatch, got %v", err)
+	}
+}
+
+func TestNormalizeHostPort(t *testing.T) {
+	good := map[string]string{
+		"8080":             ":8080",
+		":8080":            ":8080",
+		"127.0.0.1:19000":  "127.0.0.1:19000",
+		"[::1]:8080":       "[::1]:8080",
+		"example.org:9999": "example.org:9999",
+	}
+	for arg, want := range good {
+		got, err := NormalizeHostPort(arg)
+		if err != nil || got != want {
+			t.Errorf("NormalizeHostPort(%q) = %q, %v; want %q", arg, got, err, want)
+		}
+	}
+	for _, arg := range []string{"", "::1:8080", "notaport", "host:port:extra"} {
+		if _, err := NormalizeHostPort(arg); err == nil {
+			t.Errorf("expected %q to be rejected", arg)
+		}
+	}
+}
+
+func TestFramedProtocolRoundTrip(t *testing.T) {
+	savedFramed, savedVer, savedSupported := FramedProtocol, ProtocolVersion, SupportedVersions
+	EnableFramedProtocol()
+	t.Cleanup(func() {
+		FramedProtocol, ProtocolVersion, SupportedVersions = savedFramed, savedVer, savedSupported
+	})
+
+	var buf bytes.Buffer
+	packets := []Packet{
+		PacketMsg{Msg: "framed hello"},
+		PacketGuess{Number: 42},
+		PacketDisconnect{Reason: GameFull},
+	}
+	for _, packet := range packets {
+		if err := SendPacket(&buf, packet); err != nil {
+			t.Fatalf("failed to send %T: %v", packet, err)
+		}
+	}
+	reader := bufio.NewReader(&buf)
+	for _, want := range packets {
+		got, err := ReadPacket(reader)
+		if err != nil {
+			t.Fatalf("failed to read %T back: %v", want, err)
+		}
+		if fmt.Sprintf("%v", got) != fmt.Sprintf("%v", want) {
+			t.Fatalf("round trip mismatch: sent %v, got %v", want, got)
+		}
+	}
+}
+
+func TestModeCombinationsAdvertiseDistinctVersions(t *testing.T) {
+	savedF, savedS, savedVer, savedSupported := FramedProtocol, SequencedProtocol, ProtocolVersion, SupportedVersions
+	t.Cleanup(func() {
+		FramedProtocol, SequencedProtocol, ProtocolVersion, SupportedVersions = savedF, savedS, savedVer, savedSupported
+	})
+
+	FramedProtocol, SequencedProtocol = false, false
+	EnableFramedProtocol()
+	if ProtocolVersion[3] != 4 {
+		t.Fatalf("framed alone should advertise v4, got %v", ProtocolVersion)
+	}
+	EnableSequencedProtocol()
+	if ProtocolVersion[3] != 6 {
+		t.Fatalf("framed+sequenced should advertise v6, got %v", ProtocolVersion)
+	}
+
+	FramedProtocol, SequencedProtocol = false, false
+	EnableSequencedProtocol()
+	if ProtocolVersion[3] != 5 {
+		t.Fatalf("sequenced alone should advertise v5, got %v", ProtocolVersion)
+	}
+	EnableFramedProtocol()
+	if ProtocolVersion[3] != 6 {
+		t.Fatalf("enable order must not matter, got %v", ProtocolVersion)
+	}
+	if len(SupportedVersions) != 1 {
+		t.Fatalf("mode builds advertise exactly their own version, got %v", SupportedVersions)
+	}
+}
+
+func TestSequencedProtocolRoundTrip(t *testing.T) {
+	savedSeq, savedVer, savedSupported := SequencedProtocol, ProtocolVersion, SupportedVersions
+	EnableSequencedProtocol()
+	t.Cleanup(func() {
+		SequencedProtocol, ProtocolVersion, SupportedVersions = savedSeq, savedVer, savedSupported
+	})
+
+	var buf bytes.Buffer
+	for i := int64(0); i < 3; i++ {
+		if err := SendPacket(&buf, PacketGuess{Number: i}); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	reader := bufio.NewReader(&buf)
+	var last uint32
+	for i := int64(0); i < 3; i++ {
+		seqPacket, err := ReadSeqPacket(reader)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		guess, ok := seqPacket.Packet.(PacketGuess)
+		if !ok || guess.Number != i {
+			t.Fatalf("round trip mismatch at %d: %#v", i, seqPacket.Packet)
+		}
+		if seqPacket.Seq <= last {
+			t.Fatalf("sequence numbers not increasing: %d after %d", seqPacket.Seq, last)
+		}
+		last = seqPacket.Seq
+	}
+}
@@ -0,0 +1,114 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// termEditor is a minimal readline: raw-mode input with backspace editing
+// and up/down history recall. Raw mode is only held while a line is being
+// read so the terminal is always restored between commands.
+type termEditor struct {
+	in      *os.File
+	history []string
+}
+
+func newLineEditor() lineReader {
+	return &termEditor{in: os.Stdin}
+}
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	var t syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return &t, nil
+}
+
+func setTermios(fd uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (e *termEditor) ReadLine() (string, error) {
+	old, err := getTermios(e.in.Fd())
+	if err != nil {
+		// Not a terminal after all; nothing sensible to edit.
+		return "", err
+	}
+	raw := *old
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(e.in.Fd(), &raw); err != nil {
+		return "", err
+	}
+	defer func() { _ = setTermios(e.in.Fd(), old) }()
+
+	var line []byte
+	histIdx := len(e.history)
+	redraw := func() {
+		fmt.Printf("\r\x1b[K%s", string(line))
+	}
+	buf := make([]byte, 1)
+	for {
+		if _, err := e.in.Read(buf); err != nil {
+			return string(line), err
+		}
+		ch := buf[0]
+		switch {
+		case ch == '\r' || ch == '\n':
+			fmt.Print("\n")
+			text := string(line)
+			if strings.TrimSpace(text) != "" {
+				e.history = append(e.history, text)
+			}
+			return text, nil
+		case ch == 127 || ch == 8: // backspace
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Print("\b \b")
+			}
+		case ch == 4: // ctrl-d
+			if len(line) == 0 {
+				fmt.Print("\n")
+				return "", io.EOF
+			}
+		case ch == 27: // escape sequence
+			var seq [2]byte
+			if _, err := io.ReadFull(e.in, seq[:]); err != nil || seq[0] != '[' {
+				continue
+			}
+			switch seq[1] {
+			case 'A': // up: older history
+				if histIdx > 0 {
+					histIdx--
+					line = []byte(e.history[histIdx])
+					redraw()
+				}
+			case 'B': // down: newer history, ending on an empty line
+				if histIdx < len(e.history)-1 {
+					histIdx++
+					line = []byte(e.history[histIdx])
+				} else {
+					histIdx = len(e.history)
+					line = nil
+				}
+				redraw()
+			}
+		case ch >= 32:
+			line = append(line, ch)
+			fmt.Printf("%c", ch)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// newLineEditor falls back to the plain reader on platforms without the
+// termios support the editor needs.
+func newLineEditor() lineReader {
+	return newPlainLineReader()
+}
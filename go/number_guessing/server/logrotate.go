@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingLogger appends lines to a file, renaming it through numbered
+// suffixes once it grows past the size limit so the log never eats the
+// disk.
+type rotatingLogger struct {
+	mu           sync.Mutex
+	path         string
+	maxBytes     int64
+	maxRotations int
+	file         *os.File
+	size         int64
+}
+
+func newRotatingLogger(path string, maxSizeMB, maxRotations int) (*rotatingLogger, error) {
+	if maxRotations < 1 {
+		maxRotations = 3
+	}
+	l := &rotatingLogger{
+		path:         path,
+		maxBytes:     int64(maxSizeMB) * 1024 * 1024,
+		maxRotations: maxRotations,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *rotatingLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// WriteLine appends one line, rotating first when the file is full.
+// Errors are swallowed after the first open so a full disk cannot take
+// the game down.
+func (l *rotatingLogger) WriteLine(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.maxBytes > 0 && l.size+int64(len(line))+1 > l.maxBytes {
+		l.rotate()
+	}
+	n, err := fmt.Fprintln(l.file, line)
+	if err == nil {
+		l.size += int64(n)
+	}
+}
+
+// rotate shifts path.N-1 → path.N for every slot, moves the live file to
+// path.1, and reopens a fresh one. The caller must hold l.mu.
+func (l *rotatingLogger) rotate() {
+	l.file.Close()
+	for i := l.maxRotations - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	_ = os.Rename(l.path, l.path+".1")
+	if err := l.open(); err != nil {
+		l.file = nil
+	}
+}
+
+func (l *rotatingLogger) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"number_guessing/game"
+
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// serveMetrics collects Prometheus-style counters for a server. The text
+// exposition format is produced by hand so the playground stays free of
+// external dependencies while staying scrapeable.
+type serveMetrics struct {
+	mu           sync.Mutex
+	guessesTotal map[string]int64
+	roundsTotal  int64
+	bucketCounts map[float64]int64
+	perRoundSum  float64
+	perRoundObs  int64
+}
+
+// guessBuckets are the histogram upper bounds for guesses per round.
+var guessBuckets = []float64{1, 2, 5, 10, 20, 50}
+
+func newServeMetrics() *serveMetrics {
+	return &serveMetrics{
+		guessesTotal: make(map[string]int64),
+		bucketCounts: make(map[float64]int64),
+	}
+}
+
+func (m *serveMetrics) observeGuess(result game.GuessResult) {
+	if m == nil {
+		return
+	}
+	label := "lesser"
+	switch result {
+	case game.Equal:
+		label = "correct"
+	case game.Greater:
+		label = "greater"
+	}
+	m.mu.Lock()
+	m.guessesTotal[label]++
+	m.mu.Unlock()
+}
+
+// observeRound records one finished round and how many guesses it took.
+func (m *serveMetrics) observeRound(guesses int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roundsTotal++
+	m.perRoundSum += float64(guesses)
+	m.perRoundObs++
+	for _, le := range guessBuckets {
+		if float64(guesses) <= le {
+			m.bucketCounts[le]++
+		}
+	}
+}
+
+// render writes the text exposition format; playersCurrent is sampled by
+// the caller at scrape time.
+func (m *serveMetrics) render(playersCurrent int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("# TYPE number_guessing_guesses_total counter\n")
+	labels := make([]string, 0, len(m.guessesTotal))
+	for label := range m.guessesTotal {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(&b, "number_guessing_guesses_total{result=%q} %d\n", label, m.guessesTotal[label])
+	}
+	b.WriteString("# TYPE number_guessing_players_current gauge\n")
+	fmt.Fprintf(&b, "number_guessing_players_current %d\n", playersCurrent)
+	b.WriteString("# TYPE number_guessing_rounds_total counter\n")
+	fmt.Fprintf(&b, "number_guessing_rounds_total %d\n", m.roundsTotal)
+	b.WriteString("# TYPE number_guessing_guesses_per_round histogram\n")
+	for _, le := range guessBuckets {
+		fmt.Fprintf(&b, "number_guessing_guesses_per_round_bucket{le=%q} %d\n", fmt.Sprint(le), m.bucketCounts[le])
+	}
+	fmt.Fprintf(&b, "number_guessing_guesses_per_round_bucket{le=\"+Inf\"} %d\n", m.perRoundObs)
+	fmt.Fprintf(&b, "number_guessing_guesses_per_round_sum %g\n", m.perRoundSum)
+	fmt.Fprintf(&b, "number_guessing_guesses_per_round_count %d\n", m.perRoundObs)
+	return b.String()
+}
@@ -0,0 +1,1996 @@
+package server
+
+import (
+	"number_guessing/game"
+	"number_guessing/protocol"
+
+	"bufio"
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// region connection serve
+
+type Player struct {
+	Name      string
+	eventChan chan game.GameEvent
+	attempts  int
+	// rtt is the last round-trip time measured by keepalive pings.
+	rtt time.Duration
+	// token lets this player resume their slot after a drop.
+	token [16]byte
+	// dropped counts consecutive events lost to a full eventChan; tooSlow
+	// is closed once the player is hopelessly behind so their handler can
+	// disconnect them.
+	dropped    int
+	tooSlow    chan struct{}
+	slowClosed bool
+	// kicked is closed when the host ejects this player.
+	kicked     chan struct{}
+	kickClosed bool
+	// rlTokens/rlLast implement the per-player guess token bucket.
+	rlTokens float64
+	rlLast   time.Time
+}
+
+// maxDroppedEvents is how many consecutive broadcasts a player may miss
+// before being disconnected as too slow.
+const maxDroppedEvents = 5
+
+// room is one independent game on a server: its own players, number,
+// turn order, and scores behind its own lock, so a busy room never blocks
+// another.
+type room struct {
+	name string
+	// owner lets an emptied room remove itself from the server's map.
+	owner *ConnectionServe
+	ctx   context.Context
+	mutex sync.Mutex
+
+	// players and spectators, like every other mutable field below, are
+	// guarded by mutex; the host entry is no exception (its teardown goes
+	// through removePlayer).
+	players       map[string]Player
+	spectators    map[string]Player
+	playerCount   uint
+	maxSpectators uint
+	number        int64
+	maxNumber     int64
+	attemptLimit  int
+
+	// turnBased restricts guessing to one player at a time, rotating in
+	// join order.
+	turnBased bool
+	turnOrder []string
+	turnIdx   int
+
+	// scores counts round wins per player name for the session.
+	scores map[string]int
+	// recentQuits remembers round state of players who dropped recently so
+	// a reconnecting player resumes where they left off.
+	recentQuits map[string]recentQuit
+	// tokens holds the per-player reconnect secrets; a token is only
+	// honored within reconnectGrace of the drop.
+	tokens map[string][16]byte
+
+	warmth         bool
+	hardMode       bool
+	hostOnlyReveal bool
+	// setter is the player who handpicked the current number, if any;
+	// they may not guess this round.
+	setter    string
+	guessRate RateLimit
+	// history is a ring of the last historySize rendered events, shown to
+	// joining clients.
+	history      []string
+	historySize  int
+	roundTimeout time.Duration
+	roundTimer   *time.Timer
+	guessTimeout time.Duration
+	guessTimer   *time.Timer
+	// turnGen increments whenever the turn changes so a stale guess-timer
+	// callback can tell it fired for a turn that already passed.
+	turnGen int
+	metrics *serveMetrics
+	gameLog *rotatingLogger
+	// roundGuessCount counts every guess of the current round for the
+	// guesses-per-round histogram.
+	roundGuessCount int
+	bestOf          int
+	// matchWins counts rounds won in the current best-of match.
+	matchWins map[string]int
+	lo, hi    int64
+	rng       *rand.Rand
+	generator game.NumberGenerator
+	logger    *slog.Logger
+	scoreFile string
+
+	rounds       int
+	totalGuesses int
+	correct      int
+	startedAt    time.Time
+}
+
+type ConnectionServe struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// rooms maps room names to their game state; "" is the default room
+	// the host console plays in. Guarded by roomsMutex (room internals
+	// have their own locks).
+	roomsMutex sync.Mutex
+	rooms      map[string]*room
+	// defaultOpts seeds the settings of rooms created on demand.
+	defaultOpts ServeOptions
+	playerCount uint
+
+	addr        string
+	password    string
+	migrate     bool
+	motdMutex   sync.Mutex
+	motd        string
+	metrics     *serveMetrics
+	gameLog     *rotatingLogger
+	logger      *slog.Logger
+	timeout     time.Duration
+	idleTimeout time.Duration
+	pingEvery   time.Duration
+	events      chan game.GameEvent
+	startedAt   time.Time
+}
+
+// newRoom builds a room from the server defaults. Only the default room
+// uses the injected rng and score file.
+func (c *ConnectionServe) newRoom(name string) *room {
+	r := &room{
+		name:           name,
+		owner:          c,
+		ctx:            c.ctx,
+		players:        make(map[string]Player),
+		spectators:     make(map[string]Player),
+		scores:         make(map[string]int),
+		recentQuits:    make(map[string]recentQuit),
+		tokens:         make(map[string][16]byte),
+		playerCount:    c.playerCount,
+		maxSpectators:  c.defaultOpts.MaxSpectators,
+		maxNumber:      c.defaultOpts.MaxNumber,
+		attemptLimit:   c.defaultOpts.AttemptLimit,
+		turnBased:      c.defaultOpts.TurnBased,
+		warmth:         c.defaultOpts.Warmth,
+		hardMode:       c.defaultOpts.HardMode,
+		hostOnlyReveal: c.defaultOpts.HostOnlyReveal,
+		guessRate:      c.defaultOpts.GuessRate,
+		historySize:    c.defaultOpts.HistorySize,
+		roundTimeout:   c.defaultOpts.RoundTimeout,
+		guessTimeout:   c.defaultOpts.GuessTimeout,
+		metrics:        c.metrics,
+		gameLog:        c.gameLog,
+		bestOf:         c.defaultOpts.BestOf,
+		matchWins:      make(map[string]int),
+		logger:         c.logger,
+		startedAt:      time.Now(),
+		rounds:         1,
+	}
+	if name == "" {
+		r.turnOrder = []string{"host"}
+		r.scoreFile = c.defaultOpts.ScoreFile
+		r.rng = c.defaultOpts.Rng
+		r.generator = c.defaultOpts.Generator
+	}
+	if r.rng == nil {
+		r.rng = game.NewDefaultRng()
+	}
+	r.loadScores()
+	r.number = r.nextNumber()
+	r.lo, r.hi = 0, r.maxNumber
+	// Arm the first round's timer; it no-ops if the game isn't playable
+	// yet (joins that make it playable start a new round with its own).
+	r.scheduleRoundTimer()
+	return r
+}
+
+// maxRooms bounds how many rooms clients can mint on demand so a
+// hostile peer cannot grow the map without limit.
+const maxRooms = 32
+
+// roomFor returns the named room, creating it on demand. It returns nil
+// when a new room would push the server past maxRooms; the default room
+// always exists.
+func (c *ConnectionServe) roomFor(name string) *room {
+	c.roomsMutex.Lock()
+	defer c.roomsMutex.Unlock()
+	if r, ok := c.rooms[name]; ok {
+		return r
+	}
+	if name != "" && len(c.rooms) >= maxRooms {
+		return nil
+	}
+	r := c.newRoom(name)
+	c.rooms[name] = r
+	return r
+}
+
+// reapRoom removes a named room once it is empty, releasing its timers.
+// The default room is never reaped.
+func (c *ConnectionServe) reapRoom(name string) {
+	if name == "" {
+		return
+	}
+	c.roomsMutex.Lock()
+	defer c.roomsMutex.Unlock()
+	r, ok := c.rooms[name]
+	if !ok {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.players) > 0 || len(r.spectators) > 0 {
+		return
+	}
+	if r.roundTimer != nil {
+		r.roundTimer.Stop()
+	}
+	if r.guessTimer != nil {
+		r.guessTimer.Stop()
+	}
+	delete(c.rooms, name)
+}
+
+func (c *ConnectionServe) defaultRoom() *room {
+	return c.roomFor("")
+}
+
+// allRooms snapshots the room list.
+func (c *ConnectionServe) allRooms() []*room {
+	c.roomsMutex.Lock()
+	defer c.roomsMutex.Unlock()
+	rooms := make([]*room, 0, len(c.rooms))
+	for _, r := range c.rooms {
+		rooms = append(rooms, r)
+	}
+	return rooms
+}
+
+// Rooms prints every room with its occupancy.
+func (c *ConnectionServe) Rooms() {
+	c.roomsMutex.Lock()
+	names := make([]string, 0, len(c.rooms))
+	for name := range c.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rooms := make([]*room, 0, len(names))
+	for _, name := range names {
+		rooms = append(rooms, c.rooms[name])
+	}
+	c.roomsMutex.Unlock()
+	for _, r := range rooms {
+		r.mutex.Lock()
+		label := r.name
+		if label == "" {
+			label = "(default)"
+		}
+		game.PrintOutf("%s: %d/%d players, %d spectators", label, len(r.players), r.playerCount, len(r.spectators))
+		r.mutex.Unlock()
+	}
+}
+
+// RateLimit is a token bucket: Burst guesses may land at once, refilled
+// at PerSecond tokens per second.
+type RateLimit struct {
+	PerSecond float64
+	Burst     float64
+}
+
+// ParseRateLimit reads the CLI form "N/D", e.g. "1/2s" for one guess
+// every two seconds (burst N).
+func ParseRateLimit(spec string) (RateLimit, error) {
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("rate must look like N/D, e.g. 1/2s")
+	}
+	count, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || count <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate count %q", parts[0])
+	}
+	window, err := time.ParseDuration(parts[1])
+	if err != nil || window <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate window %q", parts[1])
+	}
+	return RateLimit{PerSecond: count / window.Seconds(), Burst: count}, nil
+}
+
+// reconnectGrace is how long a dropped player's round state is kept for a
+// possible reconnect.
+const reconnectGrace = 30 * time.Second
+
+type recentQuit struct {
+	attempts int
+	at       time.Time
+}
+
+// ServeOptions carries the optional game settings for a hosted session.
+type ServeOptions struct {
+	MaxNumber    int64
+	AttemptLimit int
+	TurnBased    bool
+	// Timeout bounds packet sends to clients during play; zero disables
+	// deadlines (the handshake always uses protocol.DefaultTimeout).
+	Timeout time.Duration
+	// IdleTimeout kicks a player who sends nothing for that long, with a
+	// warning at the halfway point. Zero disables the check.
+	IdleTimeout time.Duration
+	// PingInterval overrides how long a client may stay silent before a
+	// keepalive ping goes out; zero selects protocol.DefaultPingInterval.
+	PingInterval time.Duration
+	// MaxSpectators caps how many observers may watch; zero means
+	// unlimited.
+	MaxSpectators uint
+	// Rng supplies the secret numbers and name suffixes; nil selects a
+	// time-seeded source. Inject a fixed seed for reproducible games.
+	Rng *rand.Rand
+	// Generator overrides the secret number source entirely; it wins over
+	// Rng for number generation (Rng still drives name suffixes).
+	Generator game.NumberGenerator
+	// Logger receives diagnostics; nil selects protocol.DefaultLogger.
+	Logger *slog.Logger
+	// HTTPAddr starts a REST endpoint for game state inspection when
+	// non-empty. Guessing stays TCP-only.
+	HTTPAddr string
+	// Password gates joining when non-empty; clients must answer the auth
+	// challenge with it before their join is read.
+	Password string
+	// Warmth adds hot/warm/cold feedback to wrong guesses.
+	Warmth bool
+	// HardMode collapses direction feedback into a bare "wrong".
+	HardMode bool
+	// BestOf plays matches of up to N rounds, announcing a winner when a
+	// player reaches the majority. Zero disables matches.
+	BestOf int
+	// ScoreFile persists win counts as JSON across server restarts when
+	// non-empty.
+	ScoreFile string
+	// Migrate keeps the server running for the remaining players when the
+	// host stops instead of tearing the session down.
+	Migrate bool
+	// MetricsAddr exposes Prometheus-format metrics at /metrics when
+	// non-empty.
+	MetricsAddr string
+	// LogFile appends every game event (rendered) to a file when set,
+	// rotated after LogMaxSizeMB megabytes through LogMaxRotations
+	// numbered suffixes.
+	LogFile         string
+	LogMaxSizeMB    int
+	LogMaxRotations int
+	// RoundTimeout ends a round by revealing the number when nobody finds
+	// it in time; zero disables the timer.
+	RoundTimeout time.Duration
+	// GuessTimeout skips a stalled player's turn in turn-based mode; zero
+	// disables it.
+	GuessTimeout time.Duration
+	// HistorySize is how many recent events a joining client is shown;
+	// zero disables the replay (the CLI defaults to 20).
+	HistorySize int
+	// GuessRate limits guesses per player to Burst tokens refilled at
+	// PerSecond; zero disables limiting.
+	GuessRate RateLimit
+	// HostOnlyReveal restricts show and restart to the host console so
+	// remote players cannot grief the round away.
+	HostOnlyReveal bool
+	// MOTD greets every joining player when non-empty.
+	MOTD string
+}
+
+// NewConnectionServe hosts a game on a TCP listener, returning the bound
+// address so callers can pass ":0" and discover the port.
+func NewConnectionServe(host string, playerCount uint, opts ServeOptions) (game.Connection, net.Addr, error) {
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newConnectionServe(listener, playerCount, opts), listener.Addr(), nil
+}
+
+// NewConnectionServeUnix hosts a game on a Unix domain socket, removing a
+// stale socket file first. The listener unlinks the path again on stop.
+func NewConnectionServeUnix(path string, playerCount uint, opts ServeOptions) (game.Connection, error) {
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return newConnectionServe(listener, playerCount, opts), nil
+}
+
+// NewConnectionServeTLS hosts a game on a TLS listener. The handshake and
+// packet protocol are unchanged; only the transport is wrapped.
+func NewConnectionServeTLS(host string, playerCount uint, opts ServeOptions, certFile, keyFile string) (game.Connection, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair: %w", err)
+	}
+	listener, err := tls.Listen("tcp", host, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	return newConnectionServe(listener, playerCount, opts), nil
+}
+
+func newConnectionServe(listener net.Listener, playerCount uint, opts ServeOptions) game.Connection {
+	game.PrintOutf("listening on %s, range [0, %d)", listener.Addr().String(), opts.MaxNumber)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &ConnectionServe{
+		ctx:         ctx,
+		cancel:      cancel,
+		rooms:       make(map[string]*room),
+		defaultOpts: opts,
+		playerCount: playerCount,
+		timeout:     opts.Timeout,
+		idleTimeout: opts.IdleTimeout,
+		pingEvery:   opts.PingInterval,
+		events:      make(chan game.GameEvent, game.EventBufferSize),
+	}
+	conn.logger = opts.Logger
+	if conn.logger == nil {
+		conn.logger = protocol.DefaultLogger
+	}
+	conn.migrate = opts.Migrate
+	conn.password = opts.Password
+	conn.motd = opts.MOTD
+	if opts.LogFile != "" {
+		gameLog, err := newRotatingLogger(opts.LogFile, opts.LogMaxSizeMB, opts.LogMaxRotations)
+		if err != nil {
+			conn.logger.Error("game log disabled", "file", opts.LogFile, "err", err)
+		} else {
+			conn.gameLog = gameLog
+		}
+	}
+	conn.metrics = newServeMetrics()
+	if opts.MetricsAddr != "" {
+		conn.serveMetricsHTTP(opts.MetricsAddr)
+	}
+	if conn.pingEvery <= 0 {
+		conn.pingEvery = protocol.DefaultPingInterval
+	}
+	conn.startedAt = time.Now()
+	conn.addr = listener.Addr().String()
+	conn.serveDiscovery()
+	if opts.HTTPAddr != "" {
+		conn.serveHTTP(opts.HTTPAddr)
+	}
+	if conn.timeout == 0 {
+		conn.timeout = protocol.DefaultTimeout
+	}
+
+	lobby := conn.defaultRoom()
+	hostPlayer := Player{Name: "host", eventChan: make(chan game.GameEvent, 10), tooSlow: make(chan struct{}), kicked: make(chan struct{})}
+	lobby.mutex.Lock()
+	lobby.players["host"] = hostPlayer
+	lobby.mutex.Unlock()
+	conn.wg.Add(1)
+	go func() {
+		defer conn.wg.Done()
+		defer lobby.removePlayer("host")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-hostPlayer.eventChan:
+				// The forward must not outlive the session: with no
+				// consumer on events this send could otherwise block
+				// Stop() forever.
+				select {
+				case conn.events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	conn.wg.Add(1)
+	go func() {
+		defer conn.wg.Done()
+		defer listener.Close()
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-ctx.Done():
+				default:
+					conn.logger.Error("failed to accept connection", "action", "accept", "err", err)
+				}
+				return
+			}
+			conn.wg.Add(1)
+			go conn.handleClient(client)
+		}
+	}()
+
+	return conn
+}
+
+func (c *room) isPlayable() bool {
+	return uint(len(c.players)) >= c.playerCount
+}
+
+// nextNumber draws the next secret, from the injected generator when one
+// is set (clamped into range) and the room rng otherwise.
+func (c *room) nextNumber() int64 {
+	if c.generator != nil {
+		n := c.generator.Next() % c.maxNumber
+		if n < 0 {
+			n += c.maxNumber
+		}
+		return n
+	}
+	return c.rng.Int63n(c.maxNumber)
+}
+
+// scheduleRoundTimer (re)arms the round timeout for the current round.
+// The caller must hold c.mutex.
+func (c *room) scheduleRoundTimer() {
+	if c.roundTimeout <= 0 {
+		return
+	}
+	if c.roundTimer != nil {
+		c.roundTimer.Stop()
+	}
+	round := c.rounds
+	c.roundTimer = time.AfterFunc(c.roundTimeout, func() {
+		if c.ctx != nil && c.ctx.Err() != nil {
+			return
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.rounds != round || !c.isPlayable() {
+			return
+		}
+		c.broadcastEventAll(game.GameEventGameTimeout{Number: c.number})
+		c.newGame()
+	})
+}
+
+// scheduleGuessTimer arms the per-turn timer in turn-based mode. The
+// caller must hold c.mutex.
+func (c *room) scheduleGuessTimer() {
+	if !c.turnBased || c.guessTimeout <= 0 {
+		return
+	}
+	if c.guessTimer != nil {
+		c.guessTimer.Stop()
+	}
+	gen := c.turnGen
+	c.guessTimer = time.AfterFunc(c.guessTimeout, func() {
+		if c.ctx != nil && c.ctx.Err() != nil {
+			return
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.turnGen != gen || !c.isPlayable() {
+			return
+		}
+		c.broadcastEventAll(game.GameEventMessage{Text: fmt.Sprintf("%s took too long, skipping their turn", c.currentTurn())})
+		c.advanceTurn()
+	})
+}
+
+func (c *room) newGame() {
+	c.startRound(c.nextNumber(), "")
+}
+
+// startRound begins a round with the given secret. setter names the
+// player who chose it manually and is barred from guessing that round.
+// The caller must hold c.mutex.
+func (c *room) startRound(number int64, setter string) {
+	c.metrics.observeRound(c.roundGuessCount)
+	c.roundGuessCount = 0
+	c.number = number
+	c.setter = setter
+	c.lo, c.hi = 0, c.maxNumber
+	c.rounds++
+	for name, player := range c.players {
+		player.attempts = 0
+		player.rlTokens = 0
+		player.rlLast = time.Time{}
+		c.players[name] = player
+	}
+	c.broadcastEventAll(game.GameEventGameNew{})
+	c.turnIdx = 0
+	c.turnGen++
+	if c.turnBased && c.isPlayable() {
+		c.broadcastEventAll(game.GameEventTurnChange{PlayerName: c.currentTurn()})
+	}
+	c.scheduleRoundTimer()
+	c.scheduleGuessTimer()
+}
+
+// joinSuccess allocates a player slot, suffixing the name if it is taken.
+// A valid reconnect token restores the dropped slot silently; a stale or
+// wrong one is refused with protocol.TokenExpired. Without a token the reason is
+// protocol.GameFull when no slot is free.
+func (c *room) joinSuccess(name string, token [16]byte) (Player, bool, protocol.DisconnectReason) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var zero [16]byte
+	if token != zero {
+		stored, known := c.tokens[name]
+		quit, dropped := c.recentQuits[name]
+		if !known || stored != token || !dropped || time.Since(quit.at) >= reconnectGrace {
+			return Player{}, false, protocol.TokenExpired
+		}
+		// The vacated slot may have been re-filled by a fresh join during
+		// the grace window; a resume must not push the room over its
+		// player target.
+		if c.isPlayable() {
+			return Player{}, false, protocol.GameFull
+		}
+		player := Player{
+			Name:      name,
+			eventChan: make(chan game.GameEvent, 10),
+			tooSlow:   make(chan struct{}),
+			kicked:    make(chan struct{}),
+			attempts:  quit.attempts,
+			token:     stored,
+		}
+		delete(c.recentQuits, name)
+		c.players[name] = player
+		c.turnOrder = append(c.turnOrder, name)
+		return player, true, protocol.Normal
+	}
+
+	if c.isPlayable() {
+		return Player{}, false, protocol.GameFull
+	}
+	for {
+		if _, exists := c.players[name]; !exists {
+			break
+		}
+		name = name + "_" + strconv.Itoa(c.rng.Intn(100))
+	}
+	player := Player{Name: name, eventChan: make(chan game.GameEvent, 10), tooSlow: make(chan struct{}), kicked: make(chan struct{})}
+	if quit, ok := c.recentQuits[name]; ok {
+		if time.Since(quit.at) < reconnectGrace {
+			player.attempts = quit.attempts
+		}
+		delete(c.recentQuits, name)
+	}
+	if _, err := crand.Read(player.token[:]); err == nil {
+		c.tokens[name] = player.token
+	}
+	c.players[name] = player
+	c.turnOrder = append(c.turnOrder, name)
+	c.broadcastEvent(name, game.GameEventPlayerJoin{Name: name})
+	if c.isPlayable() {
+		c.newGame()
+	}
+	return player, true, protocol.Normal
+}
+
+// removePlayer deletes a player entry under the mutex; unlike leave it
+// does not announce anything, which is what the host teardown wants.
+func (c *room) removePlayer(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.players, name)
+}
+
+// joinSpectator allocates a spectator slot; spectators never occupy a
+// player slot and cannot fill the game.
+// broadcastToPlayers delivers an event to players only, skipping the
+// spectator map. The caller must hold c.mutex.
+func (c *room) broadcastToPlayers(event game.GameEvent) {
+	if c.gameLog != nil {
+		c.gameLog.WriteLine(game.GameEventToString(event))
+	}
+	for name, player := range c.players {
+		c.players[name] = c.deliverEvent(player, event)
+	}
+}
+
+func (c *room) joinSpectator(name string) (Player, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maxSpectators > 0 && uint(len(c.spectators)) >= c.maxSpectators {
+		return Player{}, false
+	}
+	for {
+		_, isPlayer := c.players[name]
+		_, isSpectator := c.spectators[name]
+		if !isPlayer && !isSpectator {
+			break
+		}
+		name = name + "_" + strconv.Itoa(c.rng.Intn(100))
+	}
+	spectator := Player{Name: name, eventChan: make(chan game.GameEvent, 10), tooSlow: make(chan struct{}), kicked: make(chan struct{})}
+	c.spectators[name] = spectator
+	c.broadcastToPlayers(game.GameEventSpectatorJoin{Name: name})
+	return spectator, true
+}
+
+func (c *room) leaveSpectator(name string) {
+	c.mutex.Lock()
+	delete(c.spectators, name)
+	c.broadcastToPlayers(game.GameEventSpectatorLeave{Name: name})
+	empty := len(c.players) == 0 && len(c.spectators) == 0
+	c.mutex.Unlock()
+	if empty {
+		c.owner.reapRoom(c.name)
+	}
+}
+
+func (c *room) leave(name string) {
+	c.mutex.Lock()
+	if player, ok := c.players[name]; ok {
+		c.recentQuits[name] = recentQuit{attempts: player.attempts, at: time.Now()}
+	}
+	delete(c.players, name)
+	wasCurrent := c.turnBased && c.currentTurn() == name
+	for i, n := range c.turnOrder {
+		if n == name {
+			c.turnOrder = append(c.turnOrder[:i], c.turnOrder[i+1:]...)
+			if i < c.turnIdx {
+				c.turnIdx--
+			}
+			break
+		}
+	}
+	if len(c.turnOrder) > 0 {
+		c.turnIdx %= len(c.turnOrder)
+	} else {
+		c.turnIdx = 0
+	}
+	c.broadcastEvent(name, game.GameEventPlayerQuit{Name: name})
+	if !c.isPlayable() {
+		c.broadcastEventAll(game.GameEventGameStop{Reason: "not enough players"})
+	} else if wasCurrent {
+		// The turn moved to a new player: invalidate the leaver's guess
+		// timer and arm a fresh one, exactly as advanceTurn would.
+		c.turnGen++
+		c.broadcastEventAll(game.GameEventTurnChange{PlayerName: c.currentTurn()})
+		c.scheduleGuessTimer()
+	}
+	empty := len(c.players) == 0 && len(c.spectators) == 0
+	c.mutex.Unlock()
+	if empty {
+		c.owner.reapRoom(c.name)
+	}
+}
+
+// broadcastEvent sends an event to every player and spectator except the
+// named one. Sends never block: a full buffer drops the event, and a
+// player who misses maxDroppedEvents in a row is flagged for a protocol.TooSlow
+// disconnect so one stalled client cannot wedge the server. The caller
+// must hold c.mutex.
+func (c *room) broadcastEvent(exclude string, event game.GameEvent) {
+	if c.gameLog != nil || c.historySize > 0 {
+		line := game.GameEventToString(event)
+		if c.gameLog != nil {
+			c.gameLog.WriteLine(line)
+		}
+		if c.historySize > 0 {
+			c.history = append(c.history, line)
+			if len(c.history) > c.historySize {
+				c.history = c.history[len(c.history)-c.historySize:]
+			}
+		}
+	}
+	for name, player := range c.players {
+		if name == exclude {
+			continue
+		}
+		c.players[name] = c.deliverEvent(player, event)
+	}
+	for name, spectator := range c.spectators {
+		if name == exclude {
+			continue
+		}
+		c.spectators[name] = c.deliverEvent(spectator, event)
+	}
+}
+
+// deliverEvent performs one non-blocking delivery, maintaining the drop
+// counter and closing tooSlow at the threshold. The host is exempt from
+// the kick since its feed is drained in-process.
+func (c *room) deliverEvent(player Player, event game.GameEvent) Player {
+	select {
+	case player.eventChan <- event:
+		player.dropped = 0
+	default:
+		player.dropped++
+		if player.dropped >= maxDroppedEvents && !player.slowClosed && player.Name != "host" {
+			c.logger.Warn("disconnecting slow consumer", "player", player.Name, "dropped", player.dropped)
+			close(player.tooSlow)
+			player.slowClosed = true
+		}
+	}
+	return player
+}
+
+// broadcastEventAll sends an event to every player and spectator. The
+// caller must hold c.mutex.
+func (c *room) broadcastEventAll(event game.GameEvent) {
+	c.broadcastEvent("", event)
+}
+
+// guess evaluates a guess for the named player. It returns the result and
+// how many attempts the player has left, with remaining < 0 meaning the
+// attempt limit is disabled.
+func (c *room) guess(name string, number int64) (game.GuessResult, int, int, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var result game.GuessResult
+	switch {
+	case number < c.number:
+		result = game.Lesser
+	case number > c.number:
+		result = game.Greater
+	default:
+		result = game.Equal
+	}
+	proximity := ""
+	if c.warmth && result != game.Equal {
+		proximity = game.ProximityBucket(number, c.number, c.maxNumber)
+	}
+	switch result {
+	case game.Lesser:
+		if number+1 > c.lo {
+			c.lo = number + 1
+		}
+	case game.Greater:
+		if number < c.hi {
+			c.hi = number
+		}
+	}
+	attempts := c.countAttempt(name)
+	c.totalGuesses++
+	c.roundGuessCount++
+	c.metrics.observeGuess(result)
+	shown := result
+	if c.hardMode && result != game.Equal {
+		shown = game.Wrong
+		proximity = ""
+	}
+	c.broadcastEvent(name, game.GameEventGameGuess{Name: name, Number: number, Result: shown, Attempts: attempts, Proximity: proximity})
+	if result == game.Equal {
+		c.correct++
+		c.scores[name]++
+		c.saveScores()
+		c.countMatchWin(name)
+		c.broadcastEventAll(game.GameEventRoundEnd{Winner: name, Round: c.rounds, Guesses: c.roundGuesses()})
+		c.broadcastEvent("host", game.GameEventScoreboard{Scores: c.snapshotScores()})
+		c.newGame()
+		return shown, -1, attempts, proximity
+	}
+	if c.attemptLimit <= 0 {
+		c.advanceTurn()
+		return shown, -1, attempts, proximity
+	}
+	remaining := c.attemptLimit - attempts
+	if remaining <= 0 {
+		c.broadcastEventAll(game.GameEventGameLost{Name: name, Number: c.number})
+		c.newGame()
+		return shown, 0, attempts, proximity
+	}
+	c.advanceTurn()
+	return shown, remaining, attempts, proximity
+}
+
+// countMatchWin tallies a round win toward the best-of match and ends the
+// match when the winner reaches a majority. The caller must hold c.mutex.
+func (c *room) countMatchWin(name string) {
+	if c.bestOf <= 0 {
+		return
+	}
+	c.matchWins[name]++
+	if c.matchWins[name] <= c.bestOf/2 {
+		return
+	}
+	wins := make(map[string]int, len(c.matchWins))
+	for player, count := range c.matchWins {
+		wins[player] = count
+	}
+	c.broadcastEventAll(game.GameEventMatchOver{Winner: name, Wins: wins})
+	c.matchWins = make(map[string]int)
+}
+
+// bounds returns the remaining valid range. The caller must hold c.mutex.
+func (c *room) bounds() (int64, int64) {
+	return c.lo, c.hi
+}
+
+// roundGuesses snapshots every player's guess count for the current round.
+// The caller must hold c.mutex.
+func (c *room) roundGuesses() map[string]int {
+	guesses := make(map[string]int, len(c.players))
+	for name, player := range c.players {
+		guesses[name] = player.attempts
+	}
+	return guesses
+}
+
+// loadScores pre-populates the win table from the score file, if any.
+func (c *room) loadScores() {
+	if c.scoreFile == "" {
+		return
+	}
+	data, err := os.ReadFile(c.scoreFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			c.logger.Error("failed to read score file", "file", c.scoreFile, "err", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &c.scores); err != nil {
+		c.logger.Error("failed to parse score file", "file", c.scoreFile, "err", err)
+	}
+}
+
+// saveScores writes the win table to the score file. The caller must hold
+// c.mutex.
+func (c *room) saveScores() {
+	if c.scoreFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(c.scores, "", "  ")
+	if err != nil {
+		c.logger.Error("failed to encode scores", "err", err)
+		return
+	}
+	if err := os.WriteFile(c.scoreFile, data, 0o644); err != nil {
+		c.logger.Error("failed to write score file", "file", c.scoreFile, "err", err)
+	}
+}
+
+// snapshotScores copies the win table for broadcasting. The caller must
+// hold c.mutex.
+func (c *room) snapshotScores() map[string]int {
+	scores := make(map[string]int, len(c.scores))
+	for name, score := range c.scores {
+		scores[name] = score
+	}
+	return scores
+}
+
+// serveDiscovery answers UDP discovery probes with this server's address
+// and occupancy until the session stops. Failing to claim the discovery
+// port (another server already has it) only disables discovery.
+func (c *ConnectionServe) serveDiscovery() {
+	udp, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", protocol.DiscoveryPort))
+	if err != nil {
+		c.logger.Warn("discovery disabled", "err", err)
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer udp.Close()
+		go func() {
+			<-c.ctx.Done()
+			udp.Close()
+		}()
+		buf := make([]byte, 64)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(buf[:n], protocol.DiscoveryMagic) {
+				continue
+			}
+			current := uint(0)
+			for _, r := range c.allRooms() {
+				r.mutex.Lock()
+				current += uint(len(r.players))
+				r.mutex.Unlock()
+			}
+			info := protocol.ServerInfo{
+				Addr:           c.addr,
+				PlayerCount:    c.playerCount,
+				CurrentPlayers: current,
+				Version:        [4]byte(protocol.ProtocolVersion),
+			}
+			_, _ = udp.WriteTo(protocol.MarshalServerInfo(info), from)
+		}
+	}()
+}
+
+// serveHTTP exposes read-only game state plus a broadcast endpoint over
+// HTTP, sharing the session context so Stop() shuts it down.
+func (c *ConnectionServe) serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		current, rounds := 0, 0
+		for _, r := range c.allRooms() {
+			r.mutex.Lock()
+			current += len(r.players)
+			rounds += r.rounds
+			r.mutex.Unlock()
+		}
+		state := map[string]int{
+			"current_players": current,
+			"max_players":     int(c.playerCount),
+			"rounds":          rounds,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(state)
+	})
+	mux.HandleFunc("/players", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var names []string
+		for _, r := range c.allRooms() {
+			r.mutex.Lock()
+			names = append(names, r.playerNames()...)
+			r.mutex.Unlock()
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(names)
+	})
+	mux.HandleFunc("/message", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Msg string `json:"msg"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Msg == "" {
+			http.Error(w, "expected {\"msg\":\"...\"}", http.StatusBadRequest)
+			return
+		}
+		for _, r := range c.allRooms() {
+			r.mutex.Lock()
+			r.broadcastEventAll(game.GameEventMessage{Text: body.Msg})
+			r.mutex.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.logger.Error("http server failed", "addr", addr, "err", err)
+		}
+	}()
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		<-c.ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+}
+
+// serveMetricsHTTP exposes the Prometheus text format at /metrics,
+// sharing the session context like the inspection API.
+func (c *ConnectionServe) serveMetricsHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		current := 0
+		for _, room := range c.allRooms() {
+			room.mutex.Lock()
+			current += len(room.players)
+			room.mutex.Unlock()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(c.metrics.render(current)))
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.logger.Error("metrics server failed", "addr", addr, "err", err)
+		}
+	}()
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		<-c.ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+}
+
+// SetNumber lets the host choose the secret for a fresh round; the host
+// is barred from guessing until the next round so the game stays fair.
+func (c *ConnectionServe) SetNumber(number int64) error {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if number < 0 || number >= r.maxNumber {
+		return fmt.Errorf("number must be in [0, %d)", r.maxNumber)
+	}
+	r.startRound(number, "host")
+	return nil
+}
+
+// SetMOTD updates the greeting shown to future joiners; the change needs
+// no reconnect.
+func (c *ConnectionServe) SetMOTD(text string) {
+	c.motdMutex.Lock()
+	defer c.motdMutex.Unlock()
+	c.motd = text
+}
+
+func (c *ConnectionServe) currentMOTD() string {
+	c.motdMutex.Lock()
+	defer c.motdMutex.Unlock()
+	return c.motd
+}
+
+// remotePlayerCount counts connected players other than the host across
+// all rooms.
+func (c *ConnectionServe) remotePlayerCount() int {
+	count := 0
+	for _, r := range c.allRooms() {
+		r.mutex.Lock()
+		for name := range r.players {
+			if name != "host" {
+				count++
+			}
+		}
+		r.mutex.Unlock()
+	}
+	return count
+}
+
+// Addr reports the address the server is actually listening on, useful
+// when it was created with ":0".
+func (c *ConnectionServe) Addr() string {
+	return c.addr
+}
+
+// Status prints the current occupancy and whether the game is running.
+func (c *ConnectionServe) Status() {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state := "waiting for players"
+	if r.isPlayable() {
+		state = "running"
+	}
+	game.PrintOutf("players: %d/%d, game %s", len(r.players), r.playerCount, state)
+}
+
+// playerNames returns the connected names sorted for stable output. The
+// caller must hold c.mutex.
+func (c *room) playerNames() []string {
+	names := make([]string, 0, len(c.players))
+	for name := range c.players {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// spectatorNames mirrors playerNames for the watcher map. The caller must
+// hold c.mutex.
+func (c *room) spectatorNames() []string {
+	names := make([]string, 0, len(c.spectators))
+	for name := range c.spectators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List prints the connected players on the server console.
+func (c *ConnectionServe) List() {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	state := "waiting for players"
+	if r.isPlayable() {
+		state = "running"
+	}
+	names := r.playerNames()
+	for i, name := range names {
+		if name == "host" {
+			names[i] = "host (you)"
+		}
+	}
+	game.PrintOutf("players (%d/%d): %s — %s", len(r.players), r.playerCount, strings.Join(names, ", "), state)
+	if len(r.spectators) > 0 {
+		game.PrintOutf("spectators: %s", strings.Join(r.spectatorNames(), ", "))
+	}
+}
+
+// statsLocked snapshots session statistics. The caller must hold c.mutex.
+func (c *room) statsLocked() game.SessionStats {
+	stats := game.SessionStats{
+		Rounds:         c.rounds,
+		TotalGuesses:   c.totalGuesses,
+		CorrectGuesses: c.correct,
+		StartedAt:      c.startedAt,
+	}
+	if stats.Rounds > 0 {
+		stats.AvgGuesses = float64(stats.TotalGuesses) / float64(stats.Rounds)
+	}
+	return stats
+}
+
+// chat rebroadcasts a chat line to everyone, including while the game is
+// still waiting for players.
+func (c *room) chat(from, message string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.broadcastEventAll(game.GameEventChat{From: from, Message: message})
+}
+
+func (c *ConnectionServe) Say(message string) {
+	c.defaultRoom().chat("host", message)
+}
+
+// Kick ejects the named player: their handler sends a protocol.Kicked disconnect
+// and the normal leave path broadcasts the quit (and stops the game if it
+// drops below the player target). The host cannot be kicked.
+func (c *ConnectionServe) Kick(name, reason string) error {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if name == "host" {
+		return errors.New("cannot kick the host")
+	}
+	player, ok := r.players[name]
+	if !ok {
+		return fmt.Errorf("no such player: %s", name)
+	}
+	if !player.kickClosed {
+		if reason != "" {
+			// Tell the player why before their handler disconnects them.
+			r.players[name] = r.deliverEvent(player, game.GameEventGameStop{Reason: "kicked: " + reason})
+			player = r.players[name]
+		}
+		close(player.kicked)
+		player.kickClosed = true
+		r.players[name] = player
+	}
+	game.PrintOutf("kicked %s", name)
+	return nil
+}
+
+// Leaderboard returns the default room's rounds-won table.
+func (c *ConnectionServe) Leaderboard() map[string]int {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.snapshotScores()
+}
+
+// Hint prints the binary-search midpoint of the default room's remaining
+// range.
+func (c *ConnectionServe) Hint() {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	game.PrintOutf("try %d (valid range [%d, %d))", (r.lo+r.hi)/2, r.lo, r.hi)
+}
+
+// Ping prints the last keepalive round-trip time per connected player.
+func (c *ConnectionServe) Ping() {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range r.playerNames() {
+		if name == "host" {
+			continue
+		}
+		player := r.players[name]
+		if player.rtt > 0 {
+			game.PrintOutf("%s: %s", name, player.rtt)
+		} else {
+			game.PrintOutf("%s: not measured yet", name)
+		}
+	}
+}
+
+func (c *ConnectionServe) Stats() game.SessionStats {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.statsLocked()
+}
+
+// Scores queues the current standings on the host event feed.
+func (c *ConnectionServe) Scores() {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	scores := r.snapshotScores()
+	r.mutex.Unlock()
+	c.events <- game.GameEventScoreboard{Scores: scores}
+}
+
+// recordRTT stores the keepalive round-trip time for a player.
+func (c *room) recordRTT(name string, rtt time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	player, ok := c.players[name]
+	if !ok {
+		return
+	}
+	player.rtt = rtt
+	c.players[name] = player
+}
+
+// currentTurn returns whose turn it is, or "" when turn order does not
+// apply. The caller must hold c.mutex.
+func (c *room) currentTurn() string {
+	if !c.turnBased || len(c.turnOrder) == 0 {
+		return ""
+	}
+	return c.turnOrder[c.turnIdx%len(c.turnOrder)]
+}
+
+// turnCheck reports whether the named player may guess right now,
+// returning a rejection message otherwise.
+func (c *room) turnCheck(name string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current := c.currentTurn()
+	if current == "" || current == name {
+		return ""
+	}
+	return fmt.Sprintf("not your turn, waiting for %s", current)
+}
+
+// advanceTurn rotates to the next player and announces it. The caller must
+// hold c.mutex.
+func (c *room) advanceTurn() {
+	if !c.turnBased || len(c.turnOrder) == 0 {
+		return
+	}
+	c.turnIdx = (c.turnIdx + 1) % len(c.turnOrder)
+	c.turnGen++
+	c.broadcastEventAll(game.GameEventTurnChange{PlayerName: c.currentTurn()})
+	c.scheduleGuessTimer()
+}
+
+// allowGuess consumes a rate-limit token for the player, reporting how
+// long they must wait when the bucket is empty. A zero rate always
+// allows.
+func (c *room) allowGuess(name string) (bool, time.Duration) {
+	if c.guessRate.PerSecond <= 0 {
+		return true, 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	player, ok := c.players[name]
+	if !ok {
+		return true, 0
+	}
+	now := time.Now()
+	if player.rlLast.IsZero() {
+		player.rlTokens = c.guessRate.Burst
+	} else {
+		player.rlTokens += now.Sub(player.rlLast).Seconds() * c.guessRate.PerSecond
+		if player.rlTokens > c.guessRate.Burst {
+			player.rlTokens = c.guessRate.Burst
+		}
+	}
+	player.rlLast = now
+	if player.rlTokens >= 1 {
+		player.rlTokens--
+		c.players[name] = player
+		return true, 0
+	}
+	wait := time.Duration((1 - player.rlTokens) / c.guessRate.PerSecond * float64(time.Second))
+	c.players[name] = player
+	return false, wait
+}
+
+// countAttempt increments the named player's guess counter for the current
+// round and returns the new count. The caller must hold c.mutex.
+func (c *room) countAttempt(name string) int {
+	player, ok := c.players[name]
+	if !ok {
+		return 0
+	}
+	player.attempts++
+	c.players[name] = player
+	return player.attempts
+}
+
+func (c *room) show(name string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	number := c.number
+	c.broadcastEvent(name, game.GameEventGameShow{Name: name, Number: number})
+	c.newGame()
+	return number
+}
+
+func (c *ConnectionServe) handleClient(client net.Conn) {
+	defer c.wg.Done()
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	protocol.UpdateDeadline(client, protocol.DefaultTimeout)
+	if err := protocol.SendMagicAndProtoVer(client); err != nil {
+		protocol.FailedToSend(c.logger, "client", err)
+		return
+	}
+	if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+		if errors.Is(err, protocol.VersionMismatch) {
+			_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.VersionMismatch})
+		}
+		protocol.FailedToRecv(c.logger, "client", err)
+		return
+	}
+
+	if err := protocol.SendPacket(client, protocol.PacketAuthChallenge{Required: c.password != ""}); err != nil {
+		protocol.FailedToSend(c.logger, "client", err)
+		return
+	}
+	if c.password != "" {
+		protocol.UpdateDeadline(client, protocol.DefaultTimeout)
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			protocol.FailedToRecv(c.logger, "client", err)
+			return
+		}
+		auth, ok := packet.(protocol.PacketPassword)
+		if !ok || auth.Password != c.password {
+			_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.WrongPassword})
+			return
+		}
+	}
+
+	protocol.UpdateDeadline(client, protocol.DefaultTimeout)
+	packet, err := protocol.ReadPacket(reader)
+	if err != nil {
+		protocol.FailedToRecv(c.logger, "client", err)
+		return
+	}
+	joinAs, ok := packet.(protocol.PacketJoinAs)
+	if !ok {
+		protocol.FailedToRecv(c.logger, "client", errors.New("expected join packet"))
+		return
+	}
+	if err := protocol.ValidatePlayerName(joinAs.Name); err != nil {
+		_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.InvalidName})
+		return
+	}
+
+	r := c.roomFor(joinAs.Room)
+	if r == nil {
+		_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.GameFull})
+		return
+	}
+	spectating := joinAs.Role == protocol.RoleSpectator
+	var player Player
+	reason := protocol.GameFull
+	if spectating {
+		player, ok = r.joinSpectator(joinAs.Name)
+		if !ok {
+			reason = protocol.SpectatorsFull
+		}
+	} else {
+		player, ok, reason = r.joinSuccess(joinAs.Name, joinAs.Token)
+	}
+	if !ok {
+		_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: reason})
+		return
+	}
+	if spectating {
+		defer r.leaveSpectator(player.Name)
+	} else {
+		defer r.leave(player.Name)
+	}
+
+	protocol.UpdateSendDeadline(client, protocol.DefaultTimeout)
+	if err := protocol.SendPacket(client, protocol.PacketJoinAs{Name: player.Name, Max: r.maxNumber, Role: joinAs.Role, Room: joinAs.Room}); err != nil {
+		protocol.FailedToSend(c.logger, player.Name, err)
+		return
+	}
+	r.mutex.Lock()
+	recent := append([]string{}, r.history...)
+	r.mutex.Unlock()
+	if len(recent) > 0 {
+		if err := protocol.SendPacket(client, protocol.PacketHistory{Events: recent}); err != nil {
+			protocol.FailedToSend(c.logger, player.Name, err)
+			return
+		}
+	}
+	if motd := c.currentMOTD(); motd != "" {
+		if err := protocol.SendMsg(client, motd); err != nil {
+			protocol.FailedToSend(c.logger, player.Name, err)
+			return
+		}
+	}
+	if r.hardMode && !spectating {
+		if err := protocol.SendMsg(client, "hard mode: wrong guesses carry no direction hint"); err != nil {
+			protocol.FailedToSend(c.logger, player.Name, err)
+			return
+		}
+	}
+	var zeroToken [16]byte
+	if player.token != zeroToken {
+		if err := protocol.SendPacket(client, protocol.PacketToken{Token: player.token}); err != nil {
+			protocol.FailedToSend(c.logger, player.Name, err)
+			return
+		}
+	}
+	_ = client.SetDeadline(time.Time{})
+
+	c.serverLoop(client, reader, r, player, spectating)
+}
+
+func (c *ConnectionServe) serverLoop(client net.Conn, reader *bufio.Reader, r *room, player Player, spectating bool) {
+	recvChan := make(chan protocol.Packet)
+	recvErrChan := make(chan error)
+	// readerDone unblocks the receive goroutine when this loop returns for
+	// a non-read reason; the deferred connection close unblocks its read.
+	readerDone := make(chan struct{})
+	defer close(readerDone)
+	go func() {
+		var lastSeq uint32
+		for {
+			seqPacket, err := protocol.ReadSeqPacket(reader)
+			if err != nil {
+				select {
+				case recvErrChan <- err:
+				case <-readerDone:
+				}
+				return
+			}
+			if protocol.SequencedProtocol {
+				if seqPacket.Seq <= lastSeq {
+					c.logger.Warn("packet arrived out of order", "player", player.Name, "seq", seqPacket.Seq, "last", lastSeq)
+				}
+				lastSeq = seqPacket.Seq
+			}
+			select {
+			case recvChan <- seqPacket.Packet:
+			case <-readerDone:
+				return
+			}
+		}
+	}()
+
+	// The idle timer fires at half the timeout for a warning, then again
+	// for the kick unless a packet arrives in between.
+	var idleChan <-chan time.Time
+	var idleTimer *time.Timer
+	idleWarned := false
+	if c.idleTimeout > 0 {
+		idleTimer = time.NewTimer(c.idleTimeout / 2)
+		defer idleTimer.Stop()
+		idleChan = idleTimer.C
+	}
+	resetIdle := func() {
+		if idleTimer == nil {
+			return
+		}
+		if !idleTimer.Stop() {
+			select {
+			case <-idleTimer.C:
+			default:
+			}
+		}
+		idleTimer.Reset(c.idleTimeout / 2)
+		idleWarned = false
+	}
+
+	// Keepalive: after pingEvery of silence a ping goes out and the
+	// peer has protocol.PongWait to answer before the connection is dropped.
+	pingTimer := time.NewTimer(c.pingEvery)
+	defer pingTimer.Stop()
+	var pongTimer *time.Timer
+	var pongDeadline <-chan time.Time
+	var pingNonce uint64
+	var pingSent time.Time
+	resetPing := func() {
+		if !pingTimer.Stop() {
+			select {
+			case <-pingTimer.C:
+			default:
+			}
+		}
+		pingTimer.Reset(c.pingEvery)
+	}
+	defer func() {
+		if pongTimer != nil {
+			pongTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			protocol.UpdateSendDeadline(client, c.timeout)
+			_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.Normal})
+			return
+		case <-player.tooSlow:
+			protocol.UpdateSendDeadline(client, c.timeout)
+			_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.TooSlow})
+			return
+		case <-player.kicked:
+			protocol.UpdateSendDeadline(client, c.timeout)
+			// Kick closes the channel right after queueing the reason, so
+			// both cases are ready at once; flush pending events first or
+			// the "kicked: <reason>" message is lost to the select order.
+			// Translate exactly as the event case does: a scoreboard has
+			// its own packet and no PacketEvent encoding.
+			for drained := false; !drained; {
+				select {
+				case event := <-player.eventChan:
+					if scoreboard, ok := event.(game.GameEventScoreboard); ok {
+						_ = protocol.SendPacket(client, protocol.PacketScoreboard{Scores: scoreboard.Scores})
+					} else {
+						_ = protocol.SendPacket(client, protocol.PacketEvent{Event: event})
+					}
+				default:
+					drained = true
+				}
+			}
+			_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.Kicked})
+			return
+		case <-pingTimer.C:
+			pingNonce = rand.Uint64()
+			pingSent = time.Now()
+			protocol.UpdateSendDeadline(client, c.timeout)
+			if err := protocol.SendPacket(client, protocol.PacketPing{Nonce: pingNonce}); err != nil {
+				protocol.FailedToSend(c.logger, player.Name, err)
+				return
+			}
+			pongTimer = time.NewTimer(protocol.PongWait)
+			pongDeadline = pongTimer.C
+		case <-pongDeadline:
+			protocol.UpdateSendDeadline(client, c.timeout)
+			_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.PingTimeout})
+			return
+		case <-idleChan:
+			protocol.UpdateSendDeadline(client, c.timeout)
+			if !idleWarned {
+				idleWarned = true
+				idleTimer.Reset(c.idleTimeout / 2)
+				if err := protocol.SendPacket(client, protocol.PacketIdleWarning{}); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+				continue
+			}
+			_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.IdleTimeout})
+			return
+		case event := <-player.eventChan:
+			protocol.UpdateSendDeadline(client, c.timeout)
+			var err error
+			if scoreboard, ok := event.(game.GameEventScoreboard); ok {
+				err = protocol.SendPacket(client, protocol.PacketScoreboard{Scores: scoreboard.Scores})
+			} else {
+				err = protocol.SendPacket(client, protocol.PacketEvent{Event: event})
+			}
+			if err != nil {
+				protocol.FailedToSend(c.logger, player.Name, err)
+				return
+			}
+		case err := <-recvErrChan:
+			if errors.Is(err, protocol.ErrStringTooLong) {
+				protocol.UpdateSendDeadline(client, c.timeout)
+				_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.StringTooLong})
+			}
+			if !errors.Is(err, io.EOF) {
+				protocol.UnexpectedClose(c.logger, player.Name, err)
+			}
+			return
+		case packet := <-recvChan:
+			resetIdle()
+			resetPing()
+			switch p := packet.(type) {
+			case protocol.PacketPing:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				if err := protocol.SendPacket(client, protocol.PacketPong{Nonce: p.Nonce}); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+			case protocol.PacketPong:
+				if p.Nonce == pingNonce && pongTimer != nil {
+					pongTimer.Stop()
+					pongDeadline = nil
+					r.recordRTT(player.Name, time.Since(pingSent))
+				}
+			case protocol.PacketGuess:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				if spectating {
+					_ = protocol.SendMsg(client, "spectators cannot guess")
+					continue
+				}
+				r.mutex.Lock()
+				playable := r.isPlayable()
+				playerCount := len(r.players)
+				r.mutex.Unlock()
+				if !playable {
+					_ = protocol.SendMsgFmt(client, "waiting for players (%d/%d)", playerCount, r.playerCount)
+					continue
+				}
+				if wait := r.turnCheck(player.Name); wait != "" {
+					_ = protocol.SendMsg(client, wait)
+					continue
+				}
+				r.mutex.Lock()
+				isSetter := r.setter != "" && r.setter == player.Name
+				r.mutex.Unlock()
+				if isSetter {
+					_ = protocol.SendMsg(client, "you picked this number, sit this round out")
+					continue
+				}
+				if ok, wait := r.allowGuess(player.Name); !ok {
+					_ = protocol.SendMsgFmt(client, "slow down, next guess allowed in %.1fs", wait.Seconds())
+					continue
+				}
+				result, remaining, _, proximity := r.guess(player.Name, p.Number)
+				r.mutex.Lock()
+				lo, hi := r.bounds()
+				if r.hardMode {
+					lo, hi = 0, 0
+				}
+				r.mutex.Unlock()
+				if err := protocol.SendPacket(client, protocol.PacketGuessResult{Result: result, Number: p.Number, Lo: lo, Hi: hi}); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+				if proximity != "" {
+					if err := protocol.SendMsg(client, proximity); err != nil {
+						protocol.FailedToSend(c.logger, player.Name, err)
+						return
+					}
+				}
+				if remaining > 0 {
+					if err := protocol.SendMsgFmt(client, "%d attempts left", remaining); err != nil {
+						protocol.FailedToSend(c.logger, player.Name, err)
+						return
+					}
+				}
+			case protocol.PacketStatus:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				r.mutex.Lock()
+				resp := protocol.PacketStatusResp{
+					CurrentPlayers: uint(len(r.players)),
+					TargetPlayers:  r.playerCount,
+					Playable:       r.isPlayable(),
+				}
+				r.mutex.Unlock()
+				if err := protocol.SendPacket(client, resp); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+			case protocol.PacketPlayerListRequest:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				r.mutex.Lock()
+				names := r.playerNames()
+				watchers := r.spectatorNames()
+				r.mutex.Unlock()
+				if err := protocol.SendPacket(client, protocol.PacketPlayerList{Names: names, Target: r.playerCount, Spectators: watchers}); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+			case protocol.PacketRestart:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				if spectating {
+					_ = protocol.SendMsg(client, "spectators cannot restart the game")
+					continue
+				}
+				if r.hostOnlyReveal {
+					_ = protocol.SendMsg(client, "only the host can restart the game")
+					continue
+				}
+				r.mutex.Lock()
+				r.newGame()
+				r.mutex.Unlock()
+			case protocol.PacketChat:
+				r.chat(player.Name, p.Message)
+			case protocol.PacketStatsRequest:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				r.mutex.Lock()
+				stats := r.statsLocked()
+				r.mutex.Unlock()
+				if err := protocol.SendPacket(client, protocol.PacketStats{Stats: stats}); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+			case protocol.PacketScoreRequest:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				r.mutex.Lock()
+				scores := r.snapshotScores()
+				r.mutex.Unlock()
+				if err := protocol.SendPacket(client, protocol.PacketScoreboard{Scores: scores}); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+			case protocol.PacketShow:
+				protocol.UpdateSendDeadline(client, c.timeout)
+				if spectating {
+					_ = protocol.SendMsg(client, "spectators cannot reveal the number")
+					continue
+				}
+				if r.hostOnlyReveal {
+					_ = protocol.SendMsg(client, "only the host can reveal the number")
+					continue
+				}
+				number := r.show(player.Name)
+				if err := protocol.SendMsgFmt(client, "the number is %d", number); err != nil {
+					protocol.FailedToSend(c.logger, player.Name, err)
+					return
+				}
+			case protocol.PacketDisconnect:
+				return
+			default:
+				// A hostile or confused client must not crash the server:
+				// close just this connection.
+				c.logger.Warn("unexpected packet", "player", player.Name, "packet", fmt.Sprintf("%T", packet))
+				protocol.UpdateSendDeadline(client, c.timeout)
+				_ = protocol.SendPacket(client, protocol.PacketDisconnect{Reason: protocol.ProtocolError})
+				return
+			}
+		}
+	}
+}
+
+// lockWithContext acquires the mutex unless the context expires first.
+func lockWithContext(ctx context.Context, mu *sync.Mutex) error {
+	for {
+		if mu.TryLock() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (c *ConnectionServe) Guess(ctx context.Context, number int64) (game.GuessResult, error) {
+	r := c.defaultRoom()
+	if err := lockWithContext(ctx, &r.mutex); err != nil {
+		return 0, err
+	}
+	if !r.isPlayable() {
+		waiting := fmt.Errorf("waiting for players (%d/%d)", len(r.players), r.playerCount)
+		r.mutex.Unlock()
+		return 0, waiting
+	}
+	if current := r.currentTurn(); current != "" && current != "host" {
+		turn := fmt.Errorf("not your turn, waiting for %s", current)
+		r.mutex.Unlock()
+		return 0, turn
+	}
+	if r.setter == "host" {
+		r.mutex.Unlock()
+		return 0, errors.New("you picked this number, sit this round out")
+	}
+	r.mutex.Unlock()
+
+	// The host's guess goes through the same handler as a client packet so
+	// the two paths cannot drift; only the console feedback differs.
+	result, remaining, attempts, proximity := r.guess("host", number)
+	switch result {
+	case game.Lesser:
+		game.PrintLesser()
+	case game.Greater:
+		game.PrintGreater()
+	case game.Wrong:
+		game.PrintWrong()
+	case game.Equal:
+		game.PrintCorrectIn(attempts)
+	}
+	if proximity != "" {
+		game.PrintOut(proximity)
+	}
+	if remaining > 0 {
+		game.PrintOutf("%d attempts left", remaining)
+	}
+	// A lost round is announced by the game.GameEventGameLost broadcast, which
+	// also reaches the host's event feed.
+	return result, nil
+}
+
+func (c *ConnectionServe) Show(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	number := c.defaultRoom().show("host")
+	game.PrintOutf("the number is %d", number)
+	return number, nil
+}
+
+// stopDrainWindow is how long Stop waits between announcing the shutdown
+// and cancelling the handlers, so remote players reliably see the reason
+// before their socket closes.
+const stopDrainWindow = 200 * time.Millisecond
+
+func (c *ConnectionServe) Restart() error {
+	r := c.defaultRoom()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.newGame()
+	return nil
+}
+
+func (c *ConnectionServe) Stop() error {
+	// With migration enabled the session survives the host: the host seat
+	// is vacated, remaining players are told, and the listener plus all
+	// handlers stay alive inside this process until it exits.
+	if c.migrate && c.remotePlayerCount() > 0 {
+		lobby := c.defaultRoom()
+		lobby.mutex.Lock()
+		lobby.broadcastEvent("host", game.GameEventMessage{Text: "the host left; the server keeps running"})
+		lobby.mutex.Unlock()
+		lobby.leave("host")
+		lobby.removePlayer("host")
+		game.PrintOut("detached; the server keeps running for the remaining players")
+		return nil
+	}
+	for _, r := range c.allRooms() {
+		r.mutex.Lock()
+		r.broadcastEventAll(game.GameEventGameStop{Reason: "host stopping"})
+		r.mutex.Unlock()
+	}
+	time.Sleep(stopDrainWindow)
+	c.cancel()
+	for _, r := range c.allRooms() {
+		r.mutex.Lock()
+		if r.roundTimer != nil {
+			r.roundTimer.Stop()
+		}
+		if r.guessTimer != nil {
+			r.guessTimer.Stop()
+		}
+		r.mutex.Unlock()
+	}
+	c.wg.Wait()
+	if c.gameLog != nil {
+		c.gameLog.Close()
+	}
+	return nil
+}
+
+func (c *ConnectionServe) RemoteStopped() bool {
+	return false
+}
+
+func (c *ConnectionServe) Events() <-chan game.GameEvent {
+	return c.events
+}
+
+func (c *ConnectionServe) Context() context.Context {
+	return c.ctx
+}
+
+// endregion
@@ -0,0 +1,763 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"number_guessing/game"
+	"number_guessing/protocol"
+)
+
+// dialTestServer joins a freshly served game and returns the client side of
+// the connection with the handshake and join already done.
+func dialTestServer(t *testing.T, playerCount uint, opts ServeOptions) (game.Connection, net.Conn, *bufio.Reader) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, playerCount, opts)
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	reader := bufio.NewReader(client)
+	if err := protocol.SendMagicAndProtoVer(client); err != nil {
+		t.Fatalf("failed to send handshake: %v", err)
+	}
+	if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if packet, err := protocol.ReadPacket(reader); err != nil {
+		t.Fatalf("failed to read auth challenge: %v", err)
+	} else if _, ok := packet.(protocol.PacketAuthChallenge); !ok {
+		t.Fatalf("expected auth challenge, got %T", packet)
+	}
+	if err := protocol.SendPacket(client, protocol.PacketJoinAs{Name: "tester"}); err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+	packet, err := protocol.ReadPacket(reader)
+	if err != nil {
+		t.Fatalf("failed to read join response: %v", err)
+	}
+	if _, ok := packet.(protocol.PacketJoinAs); !ok {
+		t.Fatalf("expected join response, got %T", packet)
+	}
+	return serve, client, reader
+}
+
+func TestIdlePlayerKick(t *testing.T) {
+	_, client, reader := dialTestServer(t, 2, ServeOptions{
+		MaxNumber:   game.DefaultMaxNumber,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var warned bool
+	for {
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			t.Fatalf("connection failed before the idle kick: %v", err)
+		}
+		switch p := packet.(type) {
+		case protocol.PacketIdleWarning:
+			warned = true
+		case protocol.PacketDisconnect:
+			if !warned {
+				t.Fatal("disconnected without an idle warning first")
+			}
+			if p.Reason != protocol.IdleTimeout {
+				t.Fatalf("expected protocol.IdleTimeout disconnect, got %v", p.Reason.Error())
+			}
+			return
+		}
+	}
+}
+
+func TestIdleTimerResetsOnActivity(t *testing.T) {
+	_, client, reader := dialTestServer(t, 2, ServeOptions{
+		MaxNumber:   game.DefaultMaxNumber,
+		IdleTimeout: 400 * time.Millisecond,
+	})
+
+	// Keep guessing more often than half the idle timeout; no warning or
+	// kick should arrive while we stay active.
+	deadline := time.Now().Add(900 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if err := protocol.SendPacket(client, protocol.PacketGuess{Number: -1}); err != nil {
+			t.Fatalf("failed to send guess: %v", err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+		for {
+			packet, err := protocol.ReadPacket(reader)
+			if err != nil {
+				break // read timeout: nothing more queued
+			}
+			switch packet.(type) {
+			case protocol.PacketIdleWarning:
+				t.Fatal("got an idle warning while active")
+			case protocol.PacketDisconnect:
+				t.Fatal("got disconnected while active")
+			}
+		}
+	}
+}
+
+func TestConcurrentClientsAndStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	// A high player target keeps the game in the waiting state; the test
+	// is about join/leave churn racing the host teardown.
+	serve := newConnectionServe(listener, 50, ServeOptions{MaxNumber: game.DefaultMaxNumber})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			reader := bufio.NewReader(client)
+			if err := protocol.SendMagicAndProtoVer(client); err != nil {
+				return
+			}
+			if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+				return
+			}
+			if _, err := protocol.ReadPacket(reader); err != nil {
+				return
+			}
+			if err := protocol.SendPacket(client, protocol.PacketJoinAs{Name: fmt.Sprintf("p%d", i)}); err != nil {
+				return
+			}
+			_, _ = protocol.ReadPacket(reader)
+			time.Sleep(20 * time.Millisecond)
+		}(i)
+	}
+	time.Sleep(30 * time.Millisecond)
+	_ = serve.Stop()
+	wg.Wait()
+}
+
+func TestBroadcastNeverBlocksOnStalledPlayer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, 50, ServeOptions{MaxNumber: game.DefaultMaxNumber}).(*ConnectionServe)
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	lobby := serve.defaultRoom()
+	stalled := Player{Name: "stalled", eventChan: make(chan game.GameEvent, 10), tooSlow: make(chan struct{})}
+	healthy := Player{Name: "healthy", eventChan: make(chan game.GameEvent, 10), tooSlow: make(chan struct{})}
+	lobby.mutex.Lock()
+	lobby.players["stalled"] = stalled
+	lobby.players["healthy"] = healthy
+	lobby.mutex.Unlock()
+
+	// Far more events than the buffer holds: must return promptly instead
+	// of wedging on the stalled player's full channel.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 30; i++ {
+			lobby.mutex.Lock()
+			lobby.broadcastEvent("", game.GameEventGameNew{})
+			lobby.mutex.Unlock()
+			// Keep the healthy player drained like its handler would.
+			for {
+				select {
+				case <-healthy.eventChan:
+					continue
+				default:
+				}
+				break
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("broadcast blocked on a stalled player")
+	}
+
+	select {
+	case <-stalled.tooSlow:
+	default:
+		t.Fatal("stalled player was never flagged as too slow")
+	}
+}
+
+func TestNoGoroutineLeakOnClientChurn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, 50, ServeOptions{MaxNumber: game.DefaultMaxNumber})
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		reader := bufio.NewReader(client)
+		if err := protocol.SendMagicAndProtoVer(client); err != nil {
+			t.Fatalf("handshake send failed: %v", err)
+		}
+		if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		if _, err := protocol.ReadPacket(reader); err != nil {
+			t.Fatalf("auth challenge failed: %v", err)
+		}
+		if err := protocol.SendPacket(client, protocol.PacketJoinAs{Name: "churn"}); err != nil {
+			t.Fatalf("join failed: %v", err)
+		}
+		if _, err := protocol.ReadPacket(reader); err != nil {
+			t.Fatalf("join response failed: %v", err)
+		}
+		client.Close()
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		runtime.GC()
+		after := runtime.NumGoroutine()
+		if after <= before+3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d before churn, %d after", before, after)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStopAnnouncesBeforeDisconnect(t *testing.T) {
+	serve, client, reader := dialTestServer(t, 2, ServeOptions{MaxNumber: game.DefaultMaxNumber})
+
+	go func() { _ = serve.Stop() }()
+
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	sawStop := false
+	for {
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			t.Fatalf("connection failed before the disconnect: %v", err)
+		}
+		switch p := packet.(type) {
+		case protocol.PacketEvent:
+			if _, ok := p.Event.(game.GameEventGameStop); ok {
+				sawStop = true
+			}
+		case protocol.PacketDisconnect:
+			if !sawStop {
+				t.Fatal("disconnected without seeing the stop announcement first")
+			}
+			return
+		}
+	}
+}
+
+func TestHostGuessUsesSharedBroadcastPath(t *testing.T) {
+	serve, client, reader := dialTestServer(t, 2, ServeOptions{
+		MaxNumber: game.DefaultMaxNumber,
+		Generator: game.FixedGenerator{Value: 10},
+	})
+
+	if _, err := serve.Guess(context.Background(), 5); err != nil {
+		t.Fatalf("host guess failed: %v", err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			t.Fatalf("never saw the host guess broadcast: %v", err)
+		}
+		event, ok := packet.(protocol.PacketEvent)
+		if !ok {
+			continue
+		}
+		guess, ok := event.Event.(game.GameEventGameGuess)
+		if !ok {
+			continue
+		}
+		if guess.Name != "host" || guess.Number != 5 || guess.Result != game.Lesser || guess.Attempts != 1 {
+			t.Fatalf("host guess broadcast mismatch: %+v", guess)
+		}
+		return
+	}
+}
+
+func TestRoundTimeoutRevealsAndRestarts(t *testing.T) {
+	_, client, reader := dialTestServer(t, 2, ServeOptions{
+		MaxNumber:    game.DefaultMaxNumber,
+		Generator:    game.FixedGenerator{Value: 33},
+		RoundTimeout: 250 * time.Millisecond,
+	})
+
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	sawTimeout := false
+	for {
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			t.Fatalf("connection failed before the timeout event: %v", err)
+		}
+		event, ok := packet.(protocol.PacketEvent)
+		if !ok {
+			continue
+		}
+		switch e := event.Event.(type) {
+		case game.GameEventGameTimeout:
+			if e.Number != 33 {
+				t.Fatalf("timeout revealed %d, expected 33", e.Number)
+			}
+			sawTimeout = true
+		case game.GameEventGameNew:
+			if sawTimeout {
+				return // reveal followed by a fresh round: done
+			}
+		}
+	}
+}
+
+func TestHostOnlyReveal(t *testing.T) {
+	// Denied: the flag blocks remote reveals.
+	_, client, reader := dialTestServer(t, 2, ServeOptions{
+		MaxNumber:      game.DefaultMaxNumber,
+		HostOnlyReveal: true,
+	})
+	if err := protocol.SendPacket(client, protocol.PacketShow{}); err != nil {
+		t.Fatalf("failed to send show: %v", err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			t.Fatalf("connection failed: %v", err)
+		}
+		if msg, ok := packet.(protocol.PacketMsg); ok {
+			if !strings.Contains(msg.Msg, "only the host") {
+				t.Fatalf("unexpected reply: %q", msg.Msg)
+			}
+			break
+		}
+	}
+
+	// Allowed: without the flag a remote show reveals the number.
+	_, client2, reader2 := dialTestServer(t, 2, ServeOptions{MaxNumber: game.DefaultMaxNumber})
+	if err := protocol.SendPacket(client2, protocol.PacketShow{}); err != nil {
+		t.Fatalf("failed to send show: %v", err)
+	}
+	_ = client2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		packet, err := protocol.ReadPacket(reader2)
+		if err != nil {
+			t.Fatalf("connection failed: %v", err)
+		}
+		if msg, ok := packet.(protocol.PacketMsg); ok && strings.Contains(msg.Msg, "the number is") {
+			return
+		}
+	}
+}
+
+func TestOversizedJoinNameRejectsConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, 2, ServeOptions{MaxNumber: game.DefaultMaxNumber})
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+	reader := bufio.NewReader(client)
+	if err := protocol.SendMagicAndProtoVer(client); err != nil {
+		t.Fatalf("handshake send failed: %v", err)
+	}
+	if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if _, err := protocol.ReadPacket(reader); err != nil {
+		t.Fatalf("auth challenge failed: %v", err)
+	}
+
+	// A join packet whose name claims to be gigabytes long: the server
+	// must drop the connection instead of allocating.
+	frame := []byte{byte(protocol.PacketIdJoinAs)}
+	frame = binary.AppendUvarint(frame, 1<<33)
+	if _, err := client.Write(frame); err != nil {
+		t.Fatalf("failed to write poisoned join: %v", err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := protocol.ReadPacket(reader); err != nil {
+			return // connection closed on us, as expected
+		}
+	}
+}
+
+func TestUnexpectedPacketClosesOnlyThatClient(t *testing.T) {
+	serve, hostile, hostileReader := dialTestServer(t, 3, ServeOptions{MaxNumber: game.DefaultMaxNumber})
+	_ = serve
+
+	// A second, well-behaved client on the same server.
+	listenerAddr := hostile.RemoteAddr().String()
+	good, err := net.Dial("tcp", listenerAddr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer good.Close()
+	goodReader := bufio.NewReader(good)
+	if err := protocol.SendMagicAndProtoVer(good); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.CheckMagicAndProtoVer(goodReader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.ReadPacket(goodReader); err != nil {
+		t.Fatal(err)
+	}
+	if err := protocol.SendPacket(good, protocol.PacketJoinAs{Name: "good"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protocol.ReadPacket(goodReader); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hostile client sends a packet only servers may send.
+	if err := protocol.SendPacket(hostile, protocol.PacketStatusResp{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = hostile.SetReadDeadline(time.Now().Add(2 * time.Second))
+	sawProtocolError := false
+	for {
+		packet, err := protocol.ReadPacket(hostileReader)
+		if err != nil {
+			break // closed on us, fine
+		}
+		if d, ok := packet.(protocol.PacketDisconnect); ok {
+			if d.Reason == protocol.ProtocolError {
+				sawProtocolError = true
+			}
+			break
+		}
+	}
+	if !sawProtocolError {
+		t.Fatal("hostile client was not disconnected with ProtocolError")
+	}
+
+	// The well-behaved client still gets answers.
+	if err := protocol.SendPacket(good, protocol.PacketStatus{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = good.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		packet, err := protocol.ReadPacket(goodReader)
+		if err != nil {
+			t.Fatalf("well-behaved client broke too: %v", err)
+		}
+		if _, ok := packet.(protocol.PacketStatusResp); ok {
+			return
+		}
+	}
+}
+
+func TestGuessRateLimiting(t *testing.T) {
+	_, client, reader := dialTestServer(t, 2, ServeOptions{
+		MaxNumber: game.DefaultMaxNumber,
+		Generator: game.FixedGenerator{Value: 99},
+		GuessRate: RateLimit{PerSecond: 1, Burst: 5},
+	})
+
+	for i := 0; i < 50; i++ {
+		if err := protocol.SendPacket(client, protocol.PacketGuess{Number: int64(i)}); err != nil {
+			t.Fatalf("failed to send guess %d: %v", i, err)
+		}
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	results, slowdowns := 0, 0
+	for results+slowdowns < 50 {
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			break
+		}
+		switch p := packet.(type) {
+		case protocol.PacketGuessResult:
+			results++
+		case protocol.PacketMsg:
+			if strings.Contains(p.Msg, "slow down") {
+				slowdowns++
+			}
+		}
+	}
+	if results > 7 {
+		t.Fatalf("rate limiter let %d of 50 rapid guesses through (burst is 5)", results)
+	}
+	if slowdowns < 40 {
+		t.Fatalf("expected most guesses to be rejected, got %d slow-downs", slowdowns)
+	}
+}
+
+func TestPasswordGate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, 3, ServeOptions{MaxNumber: game.DefaultMaxNumber, Password: "sesame"})
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	join := func(password string) (protocol.Packet, error) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		reader := bufio.NewReader(client)
+		if err := protocol.SendMagicAndProtoVer(client); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+			t.Fatal(err)
+		}
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		challenge := packet.(protocol.PacketAuthChallenge)
+		if !challenge.Required {
+			t.Fatal("expected the challenge to require a password")
+		}
+		if err := protocol.SendPacket(client, protocol.PacketPassword{Password: password}); err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.SendPacket(client, protocol.PacketJoinAs{Name: "tester"}); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return protocol.ReadPacket(reader)
+	}
+
+	packet, err := join("wrong")
+	if err != nil {
+		t.Fatalf("wrong-password join errored instead of disconnecting: %v", err)
+	}
+	if d, ok := packet.(protocol.PacketDisconnect); !ok || d.Reason != protocol.WrongPassword {
+		t.Fatalf("expected WrongPassword disconnect, got %#v", packet)
+	}
+
+	packet, err = join("sesame")
+	if err != nil {
+		t.Fatalf("correct-password join failed: %v", err)
+	}
+	if _, ok := packet.(protocol.PacketJoinAs); !ok {
+		t.Fatalf("expected a join response, got %#v", packet)
+	}
+}
+
+func TestRateLimiterStateClearedOnDisconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, 2, ServeOptions{
+		MaxNumber: game.DefaultMaxNumber,
+		Generator: game.FixedGenerator{Value: 99},
+		GuessRate: RateLimit{PerSecond: 0.1, Burst: 1},
+	})
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	join := func() (net.Conn, *bufio.Reader) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		reader := bufio.NewReader(client)
+		if err := protocol.SendMagicAndProtoVer(client); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := protocol.ReadPacket(reader); err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.SendPacket(client, protocol.PacketJoinAs{Name: "bucket"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := protocol.ReadPacket(reader); err != nil {
+			t.Fatal(err)
+		}
+		return client, reader
+	}
+	expectAfterGuess := func(client net.Conn, reader *bufio.Reader, wantResult bool) {
+		t.Helper()
+		if err := protocol.SendPacket(client, protocol.PacketGuess{Number: 1}); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			packet, err := protocol.ReadPacket(reader)
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			switch p := packet.(type) {
+			case protocol.PacketGuessResult:
+				if !wantResult {
+					t.Fatal("guess was evaluated but should have been rate limited")
+				}
+				return
+			case protocol.PacketMsg:
+				if strings.Contains(p.Msg, "slow down") {
+					if wantResult {
+						t.Fatal("guess was rate limited but should have been evaluated")
+					}
+					return
+				}
+			}
+		}
+	}
+
+	client, reader := join()
+	expectAfterGuess(client, reader, true)  // burst consumed
+	expectAfterGuess(client, reader, false) // now limited
+	client.Close()
+	time.Sleep(100 * time.Millisecond) // let the server reap the player
+
+	client2, reader2 := join()
+	expectAfterGuess(client2, reader2, true) // fresh bucket after rejoin
+	client2.Close()
+}
+
+func TestTokenResumeRejectedWhenSlotRefilled(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, 2, ServeOptions{MaxNumber: game.DefaultMaxNumber})
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	join := func(name string, token [16]byte) (net.Conn, *bufio.Reader, protocol.Packet) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		reader := bufio.NewReader(client)
+		if err := protocol.SendMagicAndProtoVer(client); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := protocol.CheckMagicAndProtoVer(reader); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := protocol.ReadPacket(reader); err != nil {
+			t.Fatal(err)
+		}
+		if err := protocol.SendPacket(client, protocol.PacketJoinAs{Name: name, Token: token}); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		packet, err := protocol.ReadPacket(reader)
+		if err != nil {
+			t.Fatalf("no join response: %v", err)
+		}
+		return client, reader, packet
+	}
+
+	// First player fills the single remote slot and receives a token.
+	first, firstReader, packet := join("ada", [16]byte{})
+	if _, ok := packet.(protocol.PacketJoinAs); !ok {
+		t.Fatalf("expected join response, got %#v", packet)
+	}
+	var token [16]byte
+	_ = first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		packet, err := protocol.ReadPacket(firstReader)
+		if err != nil {
+			t.Fatalf("never got a token: %v", err)
+		}
+		if p, ok := packet.(protocol.PacketToken); ok {
+			token = p.Token
+			break
+		}
+	}
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// A fresh join takes the vacated slot within the grace window.
+	_, _, packet = join("grace", [16]byte{})
+	if _, ok := packet.(protocol.PacketJoinAs); !ok {
+		t.Fatalf("replacement join failed: %#v", packet)
+	}
+
+	// The token holder must not be re-admitted into a full room.
+	_, _, packet = join("ada", token)
+	disconnect, ok := packet.(protocol.PacketDisconnect)
+	if !ok || disconnect.Reason != protocol.GameFull {
+		t.Fatalf("expected GameFull for the resume into a full room, got %#v", packet)
+	}
+}
+
+func TestOnDemandRoomsAreReapedAndCapped(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serve := newConnectionServe(listener, 2, ServeOptions{MaxNumber: game.DefaultMaxNumber}).(*ConnectionServe)
+	t.Cleanup(func() { _ = serve.Stop() })
+
+	r := serve.roomFor("ephemeral")
+	if r == nil {
+		t.Fatal("failed to create an on-demand room")
+	}
+	player, ok, _ := r.joinSuccess("a", [16]byte{})
+	if !ok {
+		t.Fatal("join failed")
+	}
+	if got := len(serve.allRooms()); got != 2 {
+		t.Fatalf("expected 2 rooms while occupied, got %d", got)
+	}
+	r.leave(player.Name)
+	if got := len(serve.allRooms()); got != 1 {
+		t.Fatalf("expected the emptied room to be reaped, got %d rooms", got)
+	}
+
+	for i := 0; i < maxRooms+8; i++ {
+		serve.roomFor(fmt.Sprintf("r%d", i))
+	}
+	if got := len(serve.allRooms()); got > maxRooms {
+		t.Fatalf("room map grew past the cap: %d", got)
+	}
+	if serve.roomFor("one-more") != nil {
+		t.Fatal("expected roomFor to refuse past the cap")
+	}
+	if serve.defaultRoom() == nil {
+		t.Fatal("the default room must survive the cap")
+	}
+}